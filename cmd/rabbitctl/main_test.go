@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/streadway/amqp"
+	"github.com/theflyingcodr/rabbitmq/deadletter"
+	"github.com/theflyingcodr/rabbitmq/memory"
+)
+
+func TestWriteJSON(t *testing.T) {
+	b := memory.NewBroker()
+	conn, err := b.Dial("mem")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	ch, err := conn.Channel()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ch.QueueDeclare("q", true, false, false, false, amqp.Table{"x-dead-letter-exchange": "", "x-dead-letter-routing-key": "dlq"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ch.QueueDeclare("dlq", true, false, false, false, nil); err != nil {
+		t.Fatal(err)
+	}
+	for _, body := range []string{"first message", "second"} {
+		if err := ch.Publish("", "q", false, false, amqp.Publishing{Body: []byte(body), MessageId: body}); err != nil {
+			t.Fatal(err)
+		}
+		d, _, err := ch.Get("q", false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		d.Nack(false, false)
+	}
+
+	messages, err := deadletter.NewClient(ch).Inspect(context.Background(), "dlq", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	if err := writeJSON(&out, messages, 5); err != nil {
+		t.Fatal(err)
+	}
+
+	dec := json.NewDecoder(&out)
+	for _, want := range []string{"first...", "secon..."} {
+		var got struct {
+			RoutingKey string             `json:"routing_key"`
+			Reason     string             `json:"reason"`
+			MessageId  string             `json:"message_id"`
+			Deaths     []deadletter.Death `json:"deaths"`
+			Body       string             `json:"body"`
+		}
+		if err := dec.Decode(&got); err != nil {
+			t.Fatal(err)
+		}
+		if got.Body != want || got.RoutingKey != "q" || got.Reason != deadletter.Rejected {
+			t.Errorf("got %+v, want body %s rejected from q", got, want)
+		}
+		if len(got.Deaths) != 1 || got.Deaths[0].Queue != "q" || got.Deaths[0].Count != 1 {
+			t.Errorf("got deaths %+v, want one from q", got.Deaths)
+		}
+	}
+	if dec.More() {
+		t.Fatal("more than one line per message")
+	}
+	if q, _ := b.Queue("dlq"); q.Ready != 2 || q.Unacked != 0 {
+		t.Fatalf("dead-letter queue %+v after inspecting, want 2 ready", q)
+	}
+}
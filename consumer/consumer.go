@@ -55,8 +55,9 @@ type Consumer interface{
 	// consumer config. If it returns nil a consumer
 	// with default params will be setup
 	Init() (*ConsumerConfig, error)
-	// Prefix defines a common prefix to be added
-	// to all queue names
+	// Prefix defines a common prefix to be added to the
+	// names of all queues, the deadletter queue and consumer
+	// tags, joined by HostConfig.PrefixSeparator
 	Prefix() string
 	// Middleware can be used to implement custom
 	// middleware which gets called before messages
@@ -70,9 +71,25 @@ type Consumer interface{
 // Routes contains a set of routing keys and
 // a handlerFunc that will be used to process
 // messages meeting the routing keys
+//
+// How the queue is bound depends on the exchange type, topic & direct
+// exchanges bind each of the Keys, headers exchanges bind on Headers
+// and fanout exchanges need neither
 type Routes struct{
 	Keys []string
+	// Headers binds the queue to a headers exchange, messages are
+	// routed to the queue when their headers match these values. A
+	// nil value matches any message with the header set
+	Headers map[string]interface{}
+	// HeadersMatch is HeadersMatchAll, the default, requiring every
+	// header to match or HeadersMatchAny requiring at least one
+	HeadersMatch string
 	DeliveryFunc KeyHandlerFunc
+	// Config overrides the consumer's config for this queue,
+	// only fields that are set replace the consumer's values.
+	// Set Name or DeadletterName to give the queue its own
+	// deadletter queue, if nil the consumer's config is used
+	Config *ConsumerConfig
 }
 
 // ConsumerConfig defines the setup of a consumer
@@ -80,24 +97,70 @@ type Routes struct{
 // To set a custom config for a consumer setup a new
 // consumer struct, pass the config and return it in the Init() method
 type ConsumerConfig struct{
-	Name string
-	Durable *bool
-	AutoDelete *bool
-	NoWait *bool
-	Exclusive *bool
-	Ttl *uint
-	PrefetchCount *uint
-	PrefetchSize *uint
-	Args map[string]interface{}
-	HasDeadletter *bool
-	DeadletterName *string
+	Name string `json:"name"`
+	Durable *bool `json:"durable"`
+	AutoDelete *bool `json:"auto_delete"`
+	NoWait *bool `json:"no_wait"`
+	Exclusive *bool `json:"exclusive"`
+	// QueueType is one of the QueueType constants, quorum and stream
+	// queues must be durable and can't be exclusive or auto deleted.
+	// Defaults to QueueTypeClassic
+	QueueType *string `json:"queue_type"`
+	// DeliveryLimit is how many times a quorum queue redelivers a
+	// requeued message before dead-lettering it, sets x-delivery-limit
+	DeliveryLimit *uint `json:"delivery_limit"`
+	// MaxAge is how long a stream keeps messages, ie "7D" or "12h",
+	// sets x-max-age
+	MaxAge *string `json:"max_age"`
+	// StreamOffset is where a stream consumer starts reading when
+	// there is no saved offset, see ParseStreamOffset. Defaults to
+	// OffsetNext, it is ignored by other queue types
+	StreamOffset *string `json:"stream_offset"`
+	// OffsetStore saves the offset of each stream message handled so
+	// the consumer resumes after it on reconnect or restart, it is
+	// ignored by other queue types. If nil the host keeps offsets in
+	// memory so only reconnects resume
+	OffsetStore OffsetStore `json:"-"`
+	// Ttl is how long in milliseconds a message can wait in
+	// the queue before it expires, sets x-message-ttl
+	Ttl *uint `json:"ttl"`
+	// MaxLength & MaxLengthBytes limit the number of ready messages
+	// and their total body size, sets x-max-length & x-max-length-bytes
+	MaxLength *uint `json:"max_length"`
+	MaxLengthBytes *uint `json:"max_length_bytes"`
+	// Overflow is what happens when the queue is full, one of the
+	// Overflow constants, sets x-overflow. Requires a max length
+	Overflow *string `json:"overflow"`
+	// Lazy keeps messages on disk rather than in memory, sets x-queue-mode
+	Lazy *bool `json:"lazy"`
+	// SingleActiveConsumer delivers to one consumer at a time with the
+	// others on standby, sets x-single-active-consumer
+	SingleActiveConsumer *bool `json:"single_active_consumer"`
+	// Expires deletes the queue after it has been unused for this
+	// many milliseconds, sets x-expires
+	Expires *uint `json:"expires"`
+	PrefetchCount *uint `json:"prefetch_count"`
+	PrefetchSize *uint `json:"prefetch_size"`
+	// Args are passed as the queue arguments, the typed
+	// fields above are preferred and can't be set here as well
+	Args map[string]interface{} `json:"args"`
+	HasDeadletter *bool `json:"has_deadletter"`
+	DeadletterName *string `json:"deadletter_name"`
+	// Retry sets up retry queues so failed messages are
+	// retried with a backoff before being dead-lettered,
+	// if nil failed messages are dead-lettered straight away
+	Retry *RetryPolicy `json:"retry"`
+	// DeclarePolicy decides what DeclareQueue does when the queue
+	// already exists with different arguments, one of the
+	// DeclarePolicy constants, if nil then DeclareFail is used
+	DeclarePolicy *string `json:"declare_policy"`
 }
 
 // GetName returns the consumer name if set in config
 // otherwise it returns a random uuid
 func(c *ConsumerConfig) GetName() string{
 	if c.Name == ""{
-		c.Name = uuid.NewUUID().String()
+		c.Name = uuid.New()
 	}
 
 	return c.Name
@@ -171,15 +234,34 @@ func (e *ConsumerConfig) GetArgs() map[string]interface{}{
 	return e.Args
 }
 
-// GetArgs gets a table of arbitrary arguments
-// which are passed to the exchange
+// GetHasDeadletter returns whether failed messages are dead-lettered,
+// if nil then it returns a default of true except for stream queues
+// which don't support dead-lettering
 func (e *ConsumerConfig) GetHasDeadletter() bool{
 	if e.HasDeadletter == nil{
-		return true
+		return e.GetQueueType() != QueueTypeStream
 	}
 	return *e.HasDeadletter
 }
 
+// GetQueueType returns the type of queue to declare,
+// if nil then it returns a default of QueueTypeClassic
+func (e *ConsumerConfig) GetQueueType() string{
+	if e.QueueType == nil{
+		return QueueTypeClassic
+	}
+	return *e.QueueType
+}
+
+// GetDeclarePolicy returns the policy used when the queue exists
+// with different arguments, if nil then DeclareFail is returned
+func (e *ConsumerConfig) GetDeclarePolicy() string{
+	if e.DeclarePolicy == nil{
+		return DeclareFail
+	}
+	return *e.DeclarePolicy
+}
+
 // GetDeadletterName gets the name for the deadletter
 // queue to be setup, if nil then a name of %QueueName%.deadletter is used
 func (e *ConsumerConfig) GetDeadletterName() string{
@@ -189,68 +271,264 @@ func (e *ConsumerConfig) GetDeadletterName() string{
 	return *e.DeadletterName
 }
 
-func (c *ConsumerConfig) BuildQueue(queueName string, routes *Routes, ch *amqp.Channel, ex string) (err error) {
+// Merge returns a copy of the config with the fields set in o
+// replacing its own, Args are combined with those in o taking
+// precedence. If o is nil a copy of the config is returned
+func (c *ConsumerConfig) Merge(o *ConsumerConfig) *ConsumerConfig{
+	m := *c
+	m.Args = make(map[string]interface{}, len(c.Args))
+	for k, v := range c.Args{
+		m.Args[k] = v
+	}
+	if o == nil{
+		return &m
+	}
+
+	if o.Name != ""{
+		m.Name = o.Name
+		if o.DeadletterName == nil{
+			// the deadletter queue follows the new name
+			// rather than the consumer's
+			m.DeadletterName = nil
+		}
+	}
+	if o.Durable != nil{
+		m.Durable = o.Durable
+	}
+	if o.AutoDelete != nil{
+		m.AutoDelete = o.AutoDelete
+	}
+	if o.NoWait != nil{
+		m.NoWait = o.NoWait
+	}
+	if o.Exclusive != nil{
+		m.Exclusive = o.Exclusive
+	}
+	if o.QueueType != nil{
+		m.QueueType = o.QueueType
+	}
+	if o.DeliveryLimit != nil{
+		m.DeliveryLimit = o.DeliveryLimit
+	}
+	if o.MaxAge != nil{
+		m.MaxAge = o.MaxAge
+	}
+	if o.StreamOffset != nil{
+		m.StreamOffset = o.StreamOffset
+	}
+	if o.OffsetStore != nil{
+		m.OffsetStore = o.OffsetStore
+	}
+	if o.Ttl != nil{
+		m.Ttl = o.Ttl
+	}
+	if o.MaxLength != nil{
+		m.MaxLength = o.MaxLength
+	}
+	if o.MaxLengthBytes != nil{
+		m.MaxLengthBytes = o.MaxLengthBytes
+	}
+	if o.Overflow != nil{
+		m.Overflow = o.Overflow
+	}
+	if o.Lazy != nil{
+		m.Lazy = o.Lazy
+	}
+	if o.SingleActiveConsumer != nil{
+		m.SingleActiveConsumer = o.SingleActiveConsumer
+	}
+	if o.Expires != nil{
+		m.Expires = o.Expires
+	}
+	if o.PrefetchCount != nil{
+		m.PrefetchCount = o.PrefetchCount
+	}
+	if o.PrefetchSize != nil{
+		m.PrefetchSize = o.PrefetchSize
+	}
+	for k, v := range o.Args{
+		m.Args[k] = v
+	}
+	if o.HasDeadletter != nil{
+		m.HasDeadletter = o.HasDeadletter
+	}
+	if o.DeadletterName != nil{
+		m.DeadletterName = o.DeadletterName
+	}
+	if o.Retry != nil{
+		m.Retry = o.Retry
+	}
+	if o.DeclarePolicy != nil{
+		m.DeclarePolicy = o.DeclarePolicy
+	}
+	return &m
+}
+
+func (c *ConsumerConfig) BuildQueue(queueName string, routes *Routes, ch Channel, ex *ExchangeConfig) (err error) {
+	return c.buildQueue(queueName, routes, &ch, nil, ex)
+}
+
+// DeclareQueue builds the queue on a new channel from con which is
+// returned to consume from. If the queue or one of its retry queues
+// already exists with different arguments the DeclarePolicy is applied,
+// with DeclareFail a *DeclareConflictError is returned
+func (c *ConsumerConfig) DeclareQueue(queueName string, routes *Routes, con Connection, ex *ExchangeConfig) (Channel, error) {
+	ch, err := con.Channel()
+	if err != nil{
+		return nil, err
+	}
+	if err = c.buildQueue(queueName, routes, &ch, con, ex); err != nil{
+		ch.Close()
+		return nil, err
+	}
+	return ch, nil
+}
+
+// buildQueue declares & binds the queue, when con is set ch is replaced
+// if the broker closes it while applying the DeclarePolicy
+func (c *ConsumerConfig) buildQueue(queueName string, routes *Routes, ch *Channel, con Connection, ex *ExchangeConfig) (err error) {
 	log.Infof("setting up queue %s", queueName)
 
-	if err := ch.Qos(int(c.GetPrefetchCount()), int(c.GetPrefetchSize()), false); err != nil {
+	if err := (*ch).Qos(int(c.GetPrefetchCount()), int(c.GetPrefetchSize()), false); err != nil {
 		log.Error(err)
 	}
 
-	a := c.GetArgs()
-	if c.GetHasDeadletter() {
-		dlx := fmt.Sprintf("%s.deadletter", ex)
-		a["x-dead-letter-exchange"] = dlx
+	if err = c.Validate(); err != nil{
+		log.Errorf("invalid config for queue %s: %s", queueName, err)
+		return
 	}
 
-	_, err = ch.QueueDeclare(queueName, c.GetDurable(), c.GetAutoDelete(), c.GetExclusive(), c.GetNoWait(), a)
-	if err != nil {
-		log.Fatal(err)
+	if err = c.declareQueue(ch, con, queueName, c.GetDurable(), c.GetAutoDelete(), c.GetExclusive(), c.declareArgs(ex)); err != nil {
+		log.Errorf("error setting up queue %s: %s", queueName, err)
+		return
 	}
 
-	if err = bindQueue(routes, queueName, ch, ex, c); err != nil{
+	if err = bindQueue(routes, queueName, *ch, ex.Name, ex.GetType(), c); err != nil{
 		return
 	}
 
+	if c.Retry != nil {
+		for _, d := range c.Retry.Delays() {
+			rq := RetryQueueName(queueName, d)
+			log.Debugf("setting up retry queue %s", rq)
+			if err = c.declareQueue(ch, con, rq, c.GetDurable(), false, false, retryQueueArgs(queueName, d)); err != nil {
+				log.Errorf("error setting up retry queue %s: %s", rq, err)
+				return
+			}
+		}
+	}
+
 	log.Infof("queue %s setup", queueName)
 	return
 }
 
-func (c *ConsumerConfig) BuildDeadletterQueue(routes *Routes, ch *amqp.Channel, con *amqp.Connection,  ex string) (err error) {
-	if _, qErr := ch.QueueDeclarePassive(c.GetDeadletterName(), true, false, false, false, nil); qErr == nil{
-		ch.Close()
+// declareArgs returns the arguments the queue is declared with
+func (c *ConsumerConfig) declareArgs(ex *ExchangeConfig) map[string]interface{}{
+	a := c.QueueArgs()
+	if c.GetHasDeadletter() {
+		a["x-dead-letter-exchange"] = ex.GetDeadletterName()
+	}
+	return a
+}
+
+// deadletterArgs returns the arguments the deadletter queue is
+// declared with, a deadletter queue for a quorum queue is also a
+// quorum queue so dead-lettered messages are as safe as the originals
+func (c *ConsumerConfig) deadletterArgs() map[string]interface{}{
+	if c.GetQueueType() == QueueTypeQuorum{
+		return map[string]interface{}{"x-queue-type": QueueTypeQuorum}
+	}
+	return nil
+}
+
+// BuildDeadletterQueue declares the deadletter queue named queueName, if
+// it doesn't already exist, and binds the routes to the deadletter exchange
+func (c *ConsumerConfig) BuildDeadletterQueue(queueName string, routes *Routes, ch Channel, con Connection, ex *ExchangeConfig) (err error) {
+	// a failed passive declare closes the channel, it's
+	// still closed here to release it on the client
+	defer ch.Close()
+	if _, qErr := ch.QueueDeclarePassive(queueName, true, false, false, false, nil); qErr == nil{
 		return
 	}
 
-	log.Infof("setting up queue %s", c.GetDeadletterName())
+	log.Infof("setting up queue %s", queueName)
 	ch, err = con.Channel()
 	if err != nil{
 		return
 	}
+	defer ch.Close()
 
-	_, err = ch.QueueDeclare(c.GetDeadletterName(), true, false, false, false, nil)
+	_, err = ch.QueueDeclare(queueName, true, false, false, false, c.deadletterArgs())
 	if err != nil {
-		log.Errorf("error setting up deadletter queue named %s : %s", c.GetDeadletterName(), err.Error())
+		log.Errorf("error setting up deadletter queue named %s : %s", queueName, err.Error())
 		return
 	}
 
-	if err = bindQueue(routes, c.GetDeadletterName(), ch, fmt.Sprintf("%s.deadletter", ex), c); err != nil{
+	if err = bindQueue(routes, queueName, ch, ex.GetDeadletterName(), ex.GetType(), c); err != nil{
 		return
 	}
 
-	log.Infof("deadletter queue %s setup", c.GetDeadletterName())
-	ch.Close()
+	log.Infof("deadletter queue %s setup", queueName)
 	return
 }
 
-func bindQueue(r *Routes, k string, ch *amqp.Channel, ex string, c *ConsumerConfig) (err error) {
-	for _, key := range r.Keys {
-		log.Debugf("binding key %s to queue %s", key, k)
-		if err = ch.QueueBind(k, key, ex, c.GetNoWait(), c.Args); err != nil {
-			log.Errorf("error binding %s to queue %s: %s", key, k, err)
+func bindQueue(r *Routes, k string, ch Channel, ex, kind string, c *ConsumerConfig) (err error) {
+	bindings, err := r.Bindings(kind)
+	if err != nil{
+		log.Errorf("error binding queue %s: %s", k, err)
+		return
+	}
+	for _, b := range bindings {
+		log.Debugf("binding key %s to queue %s", b.Key, k)
+		if err = ch.QueueBind(k, b.Key, ex, c.GetNoWait(), b.Args); err != nil {
+			log.Errorf("error binding %s to queue %s: %s", b.Key, k, err)
 			return
 		}
 	}
 	return
 }
 
+const (
+	HeadersMatchAll = "all"
+	HeadersMatchAny = "any"
+)
 
+// Binding is a single binding of a queue to an exchange
+type Binding struct{
+	Key string
+	Args amqp.Table
+}
+
+// Bindings returns the bindings that route messages to the queue
+// from an exchange of the kind provided, one of the exchange type
+// constants. An error is returned if the routes can't be bound to it
+func (r *Routes) Bindings(kind string) ([]Binding, error){
+	if len(r.Headers) > 0 && kind != HEADERS_EXCHANGE{
+		return nil, fmt.Errorf("headers can only be bound to a %s exchange, not %s", HEADERS_EXCHANGE, kind)
+	}
+
+	switch kind{
+	case FANOUT_EXCHANGE:
+		// fanout exchanges ignore the key, one binding is enough
+		return []Binding{{Key: ""}}, nil
+	case HEADERS_EXCHANGE:
+		match := r.HeadersMatch
+		if match == ""{
+			match = HeadersMatchAll
+		}
+		if match != HeadersMatchAll && match != HeadersMatchAny{
+			return nil, fmt.Errorf("headers match must be %s or %s, got %q", HeadersMatchAll, HeadersMatchAny, match)
+		}
+		args := amqp.Table{"x-match": match}
+		for k, v := range r.Headers{
+			args[k] = v
+		}
+		return []Binding{{Key: "", Args: args}}, nil
+	default:
+		bindings := make([]Binding, 0, len(r.Keys))
+		for _, key := range r.Keys{
+			bindings = append(bindings, Binding{Key: key})
+		}
+		return bindings, nil
+	}
+}
@@ -0,0 +1,277 @@
+// Package consumertest provides utilities for testing
+// consumers without a broker.
+//
+// A Harness builds the same handler chain the Host would for each
+// queue a Consumer defines, deliveries pushed through it are settled
+// against a recorder so tests can assert whether each message was
+// acked, nacked or requeued
+//
+//	h, err := consumertest.New(context.Background(), NewMyConsumer(), consumer.JsonHandler)
+//	if err != nil {
+//		t.Fatal(err)
+//	}
+//	results := h.Deliver(context.Background(), "test.success", amqp.Delivery{
+//		ContentType: "application/json",
+//		Body: []byte(`{}`),
+//	})
+//	if results[0].Outcome != consumertest.Acked {
+//		t.Fatalf("expected ack, got %s", results[0].Outcome)
+//	}
+package consumertest
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/streadway/amqp"
+	"github.com/theflyingcodr/rabbitmq/consumer"
+	"github.com/theflyingcodr/rabbitmq/memory"
+)
+
+// Outcome is how a delivery was settled by the handler chain
+type Outcome int
+
+const (
+	// Unsettled means the delivery was never acked or nacked
+	Unsettled Outcome = iota
+	// Acked means the delivery was acked and removed from the queue
+	Acked
+	// Nacked means the delivery was rejected without requeue, on a
+	// broker it would be dead-lettered
+	Nacked
+	// Requeued means the delivery was rejected and requeued
+	Requeued
+	// Retried means the delivery failed and was sent to a
+	// retry queue by the consumer's retry policy
+	Retried
+)
+
+// DeadletterExchange is the exchange name the harness gives
+// retriers, messages published to it have been dead-lettered
+const DeadletterExchange = "consumertest.deadletter"
+
+func (o Outcome) String() string {
+	switch o {
+	case Acked:
+		return "acked"
+	case Nacked:
+		return "nacked"
+	case Requeued:
+		return "requeued"
+	case Retried:
+		return "retried"
+	default:
+		return "unsettled"
+	}
+}
+
+// Result records what happened to a delivery
+// pushed to one of the consumer's queues
+type Result struct {
+	Queue    string
+	Delivery amqp.Delivery
+	Outcome  Outcome
+	// Settlements is the number of times the delivery was acked or
+	// nacked, anything other than one would be a channel error on RabbitMq
+	Settlements int
+	// RetryQueue is the retry queue the delivery was sent to
+	// when the outcome is Retried, named as it is on the broker
+	RetryQueue string
+	// Published is the message sent to the retry queue or
+	// deadletter exchange by the retry policy
+	Published *amqp.Publishing
+}
+
+// Harness drives a consumer's handlers with synthetic
+// deliveries, deliveries are handled one at a time
+type Harness struct {
+	mu *sync.Mutex
+	// Config is the config returned by the consumer's
+	// Init, or the default config if it returned nil
+	Config *consumer.ConsumerConfig
+	// ExchangeType is the type of exchange Deliver routes
+	// messages as, defaults to consumer.TOPIC_EXCHANGE
+	ExchangeType string
+	routes       map[string]*consumer.Routes
+	handlers     map[string]consumer.HandlerFunc
+	ack          *recorder
+}
+
+// New calls Init, Queues and Middleware on the consumer and builds the
+// handler chain for each queue, middleware is added as host middleware.
+// Retry queues are named as a host with the default HostConfig would
+func New(ctx context.Context, c consumer.Consumer, middleware ...consumer.HostMiddleware) (*Harness, error) {
+	return NewWithHost(ctx, nil, c, middleware...)
+}
+
+// NewWithHost is New with retry queues named by hostCfg, prefixed
+// with the consumer's Prefix and hostCfg's PrefixSeparator as they
+// would be on the host. Deliveries are still addressed by the keys
+// the consumer's Queues returns
+func NewWithHost(ctx context.Context, hostCfg *consumer.HostConfig, c consumer.Consumer, middleware ...consumer.HostMiddleware) (*Harness, error) {
+	if hostCfg == nil {
+		hostCfg = &consumer.HostConfig{}
+	}
+	cfg, err := c.Init()
+	if err != nil {
+		return nil, err
+	}
+	if cfg == nil {
+		cfg = &consumer.ConsumerConfig{}
+	}
+
+	h := &Harness{
+		mu:       &sync.Mutex{},
+		Config:   cfg,
+		routes:   c.Queues(ctx),
+		handlers: make(map[string]consumer.HandlerFunc),
+		ack:      &recorder{mu: &sync.Mutex{}, results: make(map[uint64]*Result)},
+	}
+	for q, r := range h.routes {
+		dlx := ""
+		if cfg.Merge(r.Config).GetHasDeadletter() {
+			dlx = DeadletterExchange
+		}
+		retrier := consumer.NewRetrier(hostCfg.Prefixed(c.Prefix(), q), dlx, cfg.Merge(r.Config), h.ack)
+		h.handlers[q] = consumer.Chain(c, r, middleware, retrier)
+	}
+	return h, nil
+}
+
+// Queues returns the names of the queues the consumer defines
+func (h *Harness) Queues() []string {
+	names := make([]string, 0, len(h.routes))
+	for q := range h.routes {
+		names = append(names, q)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Deliver pushes d to every queue with a binding matching the routing
+// key and headers, as an exchange of ExchangeType would, returning a result
+// for each queue in name order. No results are returned if the message
+// would be unroutable
+func (h *Harness) Deliver(ctx context.Context, routingKey string, d amqp.Delivery) []Result {
+	kind := h.ExchangeType
+	if kind == "" {
+		kind = consumer.TOPIC_EXCHANGE
+	}
+
+	results := make([]Result, 0)
+	for _, q := range h.Queues() {
+		bindings, err := h.routes[q].Bindings(kind)
+		if err != nil {
+			continue
+		}
+		for _, b := range bindings {
+			if memory.Match(kind, b.Key, b.Args, routingKey, d.Headers) {
+				d.RoutingKey = routingKey
+				results = append(results, h.deliver(ctx, q, d))
+				break
+			}
+		}
+	}
+	return results
+}
+
+// DeliverTo pushes d straight to the named queue
+// regardless of its routing key
+func (h *Harness) DeliverTo(ctx context.Context, queue string, d amqp.Delivery) (Result, error) {
+	if _, ok := h.handlers[queue]; !ok {
+		return Result{}, fmt.Errorf("consumer has no queue named %s", queue)
+	}
+	return h.deliver(ctx, queue, d), nil
+}
+
+func (h *Harness) deliver(ctx context.Context, queue string, d amqp.Delivery) Result {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	r := h.ack.add(queue, &d)
+	h.handlers[queue].HandleMessage(ctx, d)
+	return h.ack.result(r)
+}
+
+// recorder is the amqp.Acknowledger for every delivery
+// pushed through the harness, it records how each was settled
+type recorder struct {
+	mu      *sync.Mutex
+	tag     uint64
+	results map[uint64]*Result
+}
+
+// QueueDeclare accepts the retry queues declared by the retrier
+func (r *recorder) QueueDeclare(name string, durable, autoDelete, exclusive, noWait bool, args amqp.Table) (amqp.Queue, error) {
+	return amqp.Queue{Name: name}, nil
+}
+
+// Publish records messages the retrier publishes for the
+// delivery currently being handled, deadlettered messages are
+// recorded as Nacked as that is their outcome on a broker
+func (r *recorder) Publish(exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	res := r.results[r.tag]
+	res.Published = &msg
+	if exchange == DeadletterExchange {
+		res.Outcome = Nacked
+		return nil
+	}
+	res.Outcome = Retried
+	res.RetryQueue = key
+	return nil
+}
+
+// add assigns d a delivery tag and sets the recorder as its acknowledger
+func (r *recorder) add(queue string, d *amqp.Delivery) uint64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.tag++
+	d.Acknowledger = r
+	d.DeliveryTag = r.tag
+	r.results[r.tag] = &Result{Queue: queue, Delivery: *d}
+	return r.tag
+}
+
+func (r *recorder) result(tag uint64) Result {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return *r.results[tag]
+}
+
+func (r *recorder) settle(tag uint64, multiple bool, o Outcome) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for t, res := range r.results {
+		if t != tag && !(multiple && t < tag && res.Outcome == Unsettled) {
+			continue
+		}
+		if res.Outcome == Unsettled {
+			res.Outcome = o
+		}
+		res.Settlements++
+	}
+	return nil
+}
+
+func (r *recorder) Ack(tag uint64, multiple bool) error {
+	return r.settle(tag, multiple, Acked)
+}
+
+func (r *recorder) Nack(tag uint64, multiple bool, requeue bool) error {
+	if requeue {
+		return r.settle(tag, multiple, Requeued)
+	}
+	return r.settle(tag, multiple, Nacked)
+}
+
+func (r *recorder) Reject(tag uint64, requeue bool) error {
+	return r.Nack(tag, false, requeue)
+}
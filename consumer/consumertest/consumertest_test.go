@@ -0,0 +1,67 @@
+package consumertest_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/streadway/amqp"
+	"github.com/theflyingcodr/rabbitmq/consumer"
+	"github.com/theflyingcodr/rabbitmq/consumer/consumertest"
+)
+
+// failing fails every delivery to its one queue, orders
+type failing struct {
+	prefix string
+}
+
+func (f *failing) Init() (*consumer.ConsumerConfig, error) {
+	return &consumer.ConsumerConfig{Name: "orders", Retry: &consumer.RetryPolicy{
+		MaxAttempts: 2,
+		Backoff:     []time.Duration{time.Second},
+	}}, nil
+}
+
+func (f *failing) Prefix() string { return f.prefix }
+
+func (f *failing) Middleware(h consumer.HandlerFunc) consumer.HandlerFunc { return h }
+
+func (f *failing) Queues(ctx context.Context) map[string]*consumer.Routes {
+	return map[string]*consumer.Routes{
+		"orders": {
+			Keys: []string{"orders.created"},
+			DeliveryFunc: func(context.Context, amqp.Delivery) error {
+				return errors.New("failed")
+			},
+		},
+	}
+}
+
+func TestRetryQueuesArePrefixed(t *testing.T) {
+	sep := "-"
+	tests := map[string]struct {
+		prefix  string
+		hostCfg *consumer.HostConfig
+		want    string
+	}{
+		"no prefix":        {"", nil, "orders.retry.1000"},
+		"default":          {"billing", nil, "billing.orders.retry.1000"},
+		"custom separator": {"billing", &consumer.HostConfig{PrefixSeparator: &sep}, "billing-orders.retry.1000"},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			h, err := consumertest.NewWithHost(context.Background(), tt.hostCfg, &failing{prefix: tt.prefix})
+			if err != nil {
+				t.Fatal(err)
+			}
+			r, err := h.DeliverTo(context.Background(), "orders", amqp.Delivery{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if r.Outcome != consumertest.Retried || r.RetryQueue != tt.want {
+				t.Fatalf("got %s to %s, want retried to %s", r.Outcome, r.RetryQueue, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,144 @@
+package consumer
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/streadway/amqp"
+)
+
+// Policies for a queue which already exists with different
+// arguments, set with ConsumerConfig.DeclarePolicy
+const (
+	// DeclareFail returns a *DeclareConflictError
+	DeclareFail = "fail"
+	// DeclarePassive consumes from the existing queue as it is,
+	// the configured arguments don't take effect until it's
+	// deleted and redeclared
+	DeclarePassive = "passive"
+	// DeclareRecreateIfEmpty deletes the existing queue and declares
+	// it with the configured arguments, but only if it has no messages
+	// or consumers, otherwise a *DeclareConflictError is returned
+	DeclareRecreateIfEmpty = "recreate_if_empty"
+)
+
+// inequivalent matches the reason RabbitMq gives when an exchange
+// or queue is redeclared with different arguments
+var inequivalent = regexp.MustCompile(`inequivalent arg '([^']*)' for (\w+) '(.*)' in vhost '[^']*': received (.*) but current is (.*)$`)
+
+// argValue matches an argument value in an inequivalent arg reason
+var argValue = regexp.MustCompile(`^(?:the value )?'(.*?)'(?: of type '[^']*')?$`)
+
+// DeclareConflictError is returned when an exchange or queue already
+// exists with arguments different to those it was declared with, the
+// broker closes the channel it was declared on
+type DeclareConflictError struct {
+	// Kind is exchange or queue
+	Kind string
+	Name string
+	// Argument is the first argument that differs, such
+	// as x-message-ttl or durable
+	Argument string
+	// Received is the value declared, empty if the
+	// argument wasn't set
+	Received string
+	// Current is the value of the existing exchange
+	// or queue, empty if it doesn't have the argument
+	Current string
+	// Err is the error the broker closed the channel with
+	Err *amqp.Error
+}
+
+func (e *DeclareConflictError) Error() string {
+	return fmt.Sprintf("%s %s already exists with %s %s, declared with %s",
+		e.Kind, e.Name, e.Argument, orNone(e.Current), orNone(e.Received))
+}
+
+// Unwrap returns the *amqp.Error from the broker
+func (e *DeclareConflictError) Unwrap() error {
+	return e.Err
+}
+
+func orNone(v string) string {
+	if v == "" {
+		return "none"
+	}
+	return v
+}
+
+// declareConflict returns err as a *DeclareConflictError if the
+// broker rejected a declare for having different arguments, any
+// other error is returned as it is
+func declareConflict(err error) error {
+	var e *amqp.Error
+	if !errors.As(err, &e) || e.Code != amqp.PreconditionFailed {
+		return err
+	}
+	m := inequivalent.FindStringSubmatch(e.Reason)
+	if m == nil {
+		return err
+	}
+	return &DeclareConflictError{
+		Kind:     m[2],
+		Name:     m[3],
+		Argument: m[1],
+		Received: parseArgValue(m[4]),
+		Current:  parseArgValue(m[5]),
+		Err:      e,
+	}
+}
+
+func parseArgValue(v string) string {
+	if v == "none" {
+		return ""
+	}
+	if m := argValue.FindStringSubmatch(v); m != nil {
+		return m[1]
+	}
+	return v
+}
+
+// declareQueue declares a queue, if it exists with different
+// arguments and con is set the DeclarePolicy is applied. The broker
+// closes ch on a conflict so it's replaced with a new channel
+func (c *ConsumerConfig) declareQueue(ch *Channel, con Connection, name string, durable, autoDelete, exclusive bool, args amqp.Table) error {
+	_, err := (*ch).QueueDeclare(name, durable, autoDelete, exclusive, c.GetNoWait(), args)
+	err = declareConflict(err)
+	var conflict *DeclareConflictError
+	if !errors.As(err, &conflict) || con == nil || c.GetDeclarePolicy() == DeclareFail {
+		return err
+	}
+
+	if *ch, err = con.Channel(); err != nil {
+		return err
+	}
+	if err := (*ch).Qos(int(c.GetPrefetchCount()), int(c.GetPrefetchSize()), false); err != nil {
+		log.Error(err)
+	}
+	q, err := (*ch).QueueDeclarePassive(name, durable, autoDelete, exclusive, false, nil)
+	if err != nil {
+		return err
+	}
+
+	switch c.GetDeclarePolicy() {
+	case DeclarePassive:
+		log.Warnf("%s, using it as it is", conflict)
+		return nil
+	case DeclareRecreateIfEmpty:
+		if q.Messages > 0 || q.Consumers > 0 {
+			log.Errorf("%s and can't be recreated as it has %d messages and %d consumers", conflict, q.Messages, q.Consumers)
+			return conflict
+		}
+		log.Warnf("%s, recreating it as it's empty", conflict)
+		// the broker refuses the delete if a message or
+		// consumer arrived since the queue was inspected
+		if _, err = (*ch).QueueDelete(name, true, true, false); err != nil {
+			return err
+		}
+		_, err = (*ch).QueueDeclare(name, durable, autoDelete, exclusive, c.GetNoWait(), args)
+		return declareConflict(err)
+	}
+	return conflict
+}
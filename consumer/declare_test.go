@@ -0,0 +1,167 @@
+package consumer_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/streadway/amqp"
+	"github.com/theflyingcodr/rabbitmq/consumer"
+	"github.com/theflyingcodr/rabbitmq/memory"
+)
+
+// declared sets up exchange ex with queue q bound to k with a ttl of a
+// second, as an earlier deploy would have
+func declared(t *testing.T) (*memory.Broker, consumer.Connection, *consumer.ExchangeConfig, *consumer.Routes) {
+	t.Helper()
+	b := memory.NewBroker()
+	conn, err := b.Dial("mem")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	ch, err := conn.Channel()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ex := &consumer.ExchangeConfig{Name: "ex"}
+	if err := ex.BuildExchange(ch); err != nil {
+		t.Fatal(err)
+	}
+	ttl := uint(1000)
+	r := &consumer.Routes{Keys: []string{"k"}, DeliveryFunc: ack}
+	if err := (&consumer.ConsumerConfig{Name: "q", Ttl: &ttl}).BuildQueue("q", r, ch, ex); err != nil {
+		t.Fatal(err)
+	}
+	return b, conn, ex, r
+}
+
+// changed returns config for q with a different ttl and the policy
+func changed(policy string) *consumer.ConsumerConfig {
+	ttl := uint(5000)
+	return &consumer.ConsumerConfig{Name: "q", Ttl: &ttl, DeclarePolicy: &policy}
+}
+
+func TestDeclareFail(t *testing.T) {
+	_, conn, ex, r := declared(t)
+	_, err := changed(consumer.DeclareFail).DeclareQueue("q", r, conn, ex)
+	var conflict *consumer.DeclareConflictError
+	if !errors.As(err, &conflict) {
+		t.Fatalf("got %v, want a DeclareConflictError", err)
+	}
+	if conflict.Kind != "queue" || conflict.Name != "q" || conflict.Argument != "x-message-ttl" {
+		t.Fatalf("conflict %+v", conflict)
+	}
+	var ae *amqp.Error
+	if !errors.As(err, &ae) || ae.Code != amqp.PreconditionFailed {
+		t.Fatalf("got %v, want it to unwrap to PRECONDITION_FAILED", err)
+	}
+}
+
+func TestDeclarePassive(t *testing.T) {
+	b, conn, ex, r := declared(t)
+	ch, err := changed(consumer.DeclarePassive).DeclareQueue("q", r, conn, ex)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ch.Close()
+	if err := ch.Publish("ex", "k", false, false, amqp.Publishing{Body: []byte("m")}); err != nil {
+		t.Fatal(err)
+	}
+	if q, _ := b.Queue("q"); q.Ready != 1 {
+		t.Fatalf("queue %+v, want the existing queue used", q)
+	}
+}
+
+func TestDeclareRecreateIfEmpty(t *testing.T) {
+	b, conn, ex, r := declared(t)
+	publish(t, b, "ex", "k", 1)
+
+	cfg := changed(consumer.DeclareRecreateIfEmpty)
+	_, err := cfg.DeclareQueue("q", r, conn, ex)
+	var conflict *consumer.DeclareConflictError
+	if !errors.As(err, &conflict) {
+		t.Fatalf("got %v, want a DeclareConflictError as q has a message", err)
+	}
+
+	ch, _ := conn.Channel()
+	if _, ok, err := ch.Get("q", true); err != nil || !ok {
+		t.Fatalf("get %v %v", ok, err)
+	}
+	if ch, err = cfg.DeclareQueue("q", r, conn, ex); err != nil {
+		t.Fatal(err)
+	}
+	// redeclared with the new ttl and bound again
+	cfg.DeclarePolicy = nil
+	if ch, err = cfg.DeclareQueue("q", r, conn, ex); err != nil {
+		t.Fatal(err)
+	}
+	publish(t, b, "ex", "k", 1)
+	if q, _ := b.Queue("q"); q.Ready != 1 {
+		t.Fatalf("queue %+v, want it bound", q)
+	}
+	ch.Close()
+}
+
+func TestDeclareFailStopsStartWithOnError(t *testing.T) {
+	b, _, ex, _ := declared(t)
+	h := consumer.NewConsumerHost(&consumer.HostConfig{Address: "mem", Dial: b.Dial})
+	h.OnError(func(err error) { t.Errorf("OnError called with %v", err) })
+	h.AddBroker(context.Background(), ex, []consumer.Consumer{
+		&testConsumer{cfg: changed(consumer.DeclareFail), queue: "q", key: "k", handler: ack},
+	})
+	err := h.Start(context.Background())
+	var conflict *consumer.DeclareConflictError
+	if !errors.As(err, &conflict) {
+		t.Fatalf("got %v, want a DeclareConflictError", err)
+	}
+}
+
+func TestInvalidDeclarePolicy(t *testing.T) {
+	if err := changed("nope").Validate(); !errors.Is(err, consumer.ERRINVALIDQUEUECONFIG) {
+		t.Fatalf("got %v, want invalid queue config", err)
+	}
+}
+
+// channelCounter wraps a connection counting
+// the channels opened and the ones closed
+type channelCounter struct {
+	consumer.Connection
+	opened, closed int
+}
+
+func (c *channelCounter) Channel() (consumer.Channel, error) {
+	ch, err := c.Connection.Channel()
+	if err != nil {
+		return nil, err
+	}
+	c.opened++
+	return &countedChannel{Channel: ch, c: c}, nil
+}
+
+type countedChannel struct {
+	consumer.Channel
+	c *channelCounter
+}
+
+func (c *countedChannel) Close() error {
+	c.c.closed++
+	return c.Channel.Close()
+}
+
+func TestBuildDeadletterQueueClosesChannelOnError(t *testing.T) {
+	_, conn, _, r := declared(t)
+	counter := &channelCounter{Connection: conn}
+	ch, err := counter.Channel()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the deadletter exchange hasn't been declared so binding fails
+	ex := &consumer.ExchangeConfig{Name: "missing"}
+	if err := (&consumer.ConsumerConfig{Name: "q"}).BuildDeadletterQueue("q.deadletter", r, ch, counter, ex); err == nil {
+		t.Fatal("expected binding to a missing exchange to fail")
+	}
+	if counter.opened != counter.closed {
+		t.Fatalf("%d channels opened, %d closed", counter.opened, counter.closed)
+	}
+}
@@ -0,0 +1,185 @@
+package consumer
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	ERRINVALIDENV = errors.New("invalid environment variable")
+)
+
+// LoadHostConfig reads a HostConfig from environment variables named
+// after its fields with the prefix, ie with a prefix of RABBITMQ the
+// address is read from RABBITMQ_ADDRESS. See LoadConsumerConfig for
+// how values are parsed
+func LoadHostConfig(prefix string) (*HostConfig, error) {
+	c := &HostConfig{}
+	return c, loadEnv(prefix, c, os.LookupEnv)
+}
+
+// LoadExchangeConfig reads an ExchangeConfig from environment
+// variables named after its fields with the prefix, ie
+// ORDERS_EXCHANGE_NAME & ORDERS_EXCHANGE_TYPE for a prefix of
+// ORDERS_EXCHANGE. See LoadConsumerConfig for how values are parsed
+func LoadExchangeConfig(prefix string) (*ExchangeConfig, error) {
+	c := &ExchangeConfig{}
+	return c, loadEnv(prefix, c, os.LookupEnv)
+}
+
+// LoadConsumerConfig reads a ConsumerConfig from environment variables
+// named after its fields in upper snake case with the prefix, ie
+// BILLING_PREFETCH_COUNT for a prefix of BILLING. The retry policy is
+// read from BILLING_RETRY_MAX_ATTEMPTS, BILLING_RETRY_BACKOFF etc.
+//
+// Optional fields are left nil when their variable is unset or empty.
+// Durations are written as "30s", lists are comma separated and
+// Args and other tables are json objects. Every malformed value
+// is reported in the error, each wraps ERRINVALIDENV
+func LoadConsumerConfig(prefix string) (*ConsumerConfig, error) {
+	c := &ConsumerConfig{}
+	return c, loadEnv(prefix, c, os.LookupEnv)
+}
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+// loadEnv populates the struct v points to from
+// the variables returned by lookup
+func loadEnv(prefix string, v interface{}, lookup func(string) (string, bool)) error {
+	errs := make([]error, 0)
+	loadStruct(envName(prefix, ""), reflect.ValueOf(v).Elem(), lookup, &errs)
+	return errors.Join(errs...)
+}
+
+// loadStruct sets each field of s from the variable named after the
+// field's json name, returning true if any variable was set
+func loadStruct(prefix string, s reflect.Value, lookup func(string) (string, bool), errs *[]error) bool {
+	set := false
+	for i := 0; i < s.NumField(); i++ {
+		f := s.Type().Field(i)
+		tag := strings.Split(f.Tag.Get("json"), ",")[0]
+		if tag == "-" || tag == "" || f.PkgPath != "" {
+			continue
+		}
+		name := envName(prefix, tag)
+		field := s.Field(i)
+
+		// nested policies are read from variables prefixed with the field name
+		if t := field.Type(); t.Kind() == reflect.Ptr && t.Elem().Kind() == reflect.Struct {
+			nested := reflect.New(t.Elem())
+			if loadStruct(name, nested.Elem(), lookup, errs) {
+				field.Set(nested)
+				set = true
+			}
+			continue
+		}
+
+		raw, ok := lookup(name)
+		if !ok || raw == "" {
+			continue
+		}
+		set = true
+		val, err := parseEnv(field.Type(), raw)
+		if err != nil {
+			*errs = append(*errs, fmt.Errorf("%w %s=%q: %s", ERRINVALIDENV, name, raw, err))
+			continue
+		}
+		field.Set(val)
+	}
+	return set
+}
+
+// parseEnv parses raw into a value of type t
+func parseEnv(t reflect.Type, raw string) (reflect.Value, error) {
+	if t.Kind() == reflect.Ptr {
+		v, err := parseEnv(t.Elem(), raw)
+		if err != nil {
+			return reflect.Value{}, err
+		}
+		p := reflect.New(t.Elem())
+		p.Elem().Set(v)
+		return p, nil
+	}
+
+	v := reflect.New(t).Elem()
+	switch {
+	case t == durationType:
+		d, err := time.ParseDuration(raw)
+		if err != nil {
+			return v, fmt.Errorf("expected a duration such as 30s")
+		}
+		v.SetInt(int64(d))
+	case t.Kind() == reflect.String:
+		v.SetString(raw)
+	case t.Kind() == reflect.Bool:
+		b, err := strconv.ParseBool(raw)
+		if err != nil {
+			return v, fmt.Errorf("expected true or false")
+		}
+		v.SetBool(b)
+	case t.Kind() == reflect.Int:
+		n, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil {
+			return v, fmt.Errorf("expected a whole number")
+		}
+		v.SetInt(n)
+	case t.Kind() == reflect.Uint:
+		n, err := strconv.ParseUint(raw, 10, 64)
+		if err != nil {
+			return v, fmt.Errorf("expected a whole number of 0 or more")
+		}
+		v.SetUint(n)
+	case t.Kind() == reflect.Float64:
+		n, err := strconv.ParseFloat(raw, 64)
+		if err != nil {
+			return v, fmt.Errorf("expected a number")
+		}
+		v.SetFloat(n)
+	case t.Kind() == reflect.Slice && (t.Elem().Kind() == reflect.String || t.Elem() == durationType):
+		for _, item := range strings.Split(raw, ",") {
+			e, err := parseEnv(t.Elem(), strings.TrimSpace(item))
+			if err != nil {
+				return v, fmt.Errorf("item %q: %s", item, err)
+			}
+			v = reflect.Append(v, e)
+		}
+	default:
+		// tables & lists of structs are json
+		p := reflect.New(t)
+		dec := json.NewDecoder(strings.NewReader(raw))
+		dec.DisallowUnknownFields()
+		dec.UseNumber()
+		if err := dec.Decode(p.Interface()); err != nil {
+			return v, fmt.Errorf("expected json: %s", err)
+		}
+		switch t := p.Elem().Interface().(type) {
+		case map[string]interface{}:
+			normaliseTable(t)
+		case []ExchangeBinding:
+			for _, b := range t {
+				normaliseTable(b.Args)
+			}
+		}
+		v.Set(p.Elem())
+	}
+	return v, nil
+}
+
+// envName joins the prefix and json name of a field into a variable name
+func envName(prefix, name string) string {
+	name = strings.ToUpper(name)
+	prefix = strings.TrimSuffix(strings.ToUpper(prefix), "_")
+	switch {
+	case prefix == "":
+		return name
+	case name == "":
+		return prefix
+	}
+	return prefix + "_" + name
+}
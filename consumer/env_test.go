@@ -0,0 +1,81 @@
+package consumer_test
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/theflyingcodr/rabbitmq/consumer"
+)
+
+func TestLoadConsumerConfig(t *testing.T) {
+	t.Setenv("BILLING_PREFETCH_COUNT", "10")
+	t.Setenv("BILLING_TTL", "")
+	t.Setenv("BILLING_ARGS", `{"x-max-priority":5}`)
+	t.Setenv("BILLING_RETRY_MAX_ATTEMPTS", "3")
+	t.Setenv("BILLING_RETRY_BACKOFF", "1s, 5s")
+	t.Setenv("BILLING_RETRY_MAX_DELAY", "1m")
+	c, err := consumer.LoadConsumerConfig("BILLING")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.GetPrefetchCount() != 10 {
+		t.Fatalf("prefetch count %d, want 10", c.GetPrefetchCount())
+	}
+	if c.Ttl != nil {
+		t.Fatalf("ttl %d, want an empty variable to leave it nil", *c.Ttl)
+	}
+	if _, ok := c.Args["x-max-priority"]; !ok {
+		t.Fatalf("args %v, want x-max-priority", c.Args)
+	}
+	if c.Retry == nil || c.Retry.MaxAttempts != 3 || c.Retry.MaxDelay == nil || *c.Retry.MaxDelay != time.Minute ||
+		!reflect.DeepEqual(c.Retry.Backoff, []time.Duration{time.Second, 5 * time.Second}) {
+		t.Fatalf("retry %+v, want 3 attempts backing off 1s, 5s up to 1m", c.Retry)
+	}
+}
+
+func TestLoadConsumerConfigReportsEveryError(t *testing.T) {
+	t.Setenv("BILLING_PREFETCH_COUNT", "-1")
+	t.Setenv("BILLING_LAZY", "maybe")
+	t.Setenv("BILLING_RETRY_BACKOFF", "1s,soon")
+	t.Setenv("BILLING_ARGS", `{bad`)
+	_, err := consumer.LoadConsumerConfig("BILLING")
+	if !errors.Is(err, consumer.ERRINVALIDENV) {
+		t.Fatalf("got %v, want invalid env", err)
+	}
+	for _, name := range []string{"BILLING_PREFETCH_COUNT", "BILLING_LAZY", "BILLING_RETRY_BACKOFF", "BILLING_ARGS"} {
+		if !strings.Contains(err.Error(), name) {
+			t.Errorf("%v doesn't name %s", err, name)
+		}
+	}
+}
+
+func TestLoadHostAndExchangeConfig(t *testing.T) {
+	t.Setenv("RABBITMQ_ADDRESSES", "amqp://x,amqp://y")
+	t.Setenv("RABBITMQ_ADDRESS_SELECTION", "random")
+	t.Setenv("RABBITMQ_PREFIX_SEPARATOR", "-")
+	h, err := consumer.LoadHostConfig("RABBITMQ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(h.GetAddresses()) != 2 || h.GetAddressSelection() != consumer.AddressRandom || h.GetPrefixSeparator() != "-" {
+		t.Fatalf("got %+v", h)
+	}
+
+	t.Setenv("ORDERS_NAME", "orders")
+	t.Setenv("ORDERS_TYPE", consumer.DIRECT_EXCHANGE)
+	t.Setenv("ORDERS_DURABLE", "false")
+	t.Setenv("ORDERS_BINDINGS", `[{"source":"upstream","keys":["a"]}]`)
+	e, err := consumer.LoadExchangeConfig("ORDERS")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.Name != "orders" || e.GetType() != consumer.DIRECT_EXCHANGE || e.GetDurable() {
+		t.Fatalf("got %+v", e)
+	}
+	if len(e.Bindings) != 1 || e.Bindings[0].Source != "upstream" {
+		t.Fatalf("bindings %+v, want one from upstream", e.Bindings)
+	}
+}
@@ -0,0 +1,101 @@
+package consumer
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+type action int
+
+const (
+	actionRequeue action = iota
+	actionDiscard
+	actionRetry
+	actionDeadLetter
+)
+
+// handlerError wraps an error returned by a KeyHandlerFunc with
+// the action the errorHandler should take for the message
+type handlerError struct {
+	action action
+	delay  time.Duration
+	err    error
+}
+
+func (e *handlerError) Error() string {
+	if e.err == nil {
+		return e.action.String()
+	}
+	return e.err.Error()
+}
+
+func (e *handlerError) Unwrap() error {
+	return e.err
+}
+
+func (a action) String() string {
+	switch a {
+	case actionRequeue:
+		return "requeue"
+	case actionDiscard:
+		return "discard"
+	case actionRetry:
+		return "retry"
+	default:
+		return "deadletter"
+	}
+}
+
+// Requeue wraps an error returned from a handler so the message
+// is nacked and put back on the queue to be delivered again, use
+// it for transient failures that should be retried immediately
+//
+//	if err := db.Save(order); err != nil {
+//		return consumer.Requeue(err)
+//	}
+func Requeue(err error) error {
+	return &handlerError{action: actionRequeue, err: err}
+}
+
+// Discard wraps an error returned from a handler so the message
+// is acked and dropped, use it for messages that can never be
+// processed and aren't worth keeping in the deadletter queue
+func Discard(err error) error {
+	return &handlerError{action: actionDiscard, err: err}
+}
+
+// RetryAfter wraps an error returned from a handler so the message
+// is sent to a retry queue and redelivered once d has passed. d is
+// rounded up to the nearest of the RetryPolicy's delays, or if there
+// isn't one to 1s, 5s, 10s, 30s, 1m, 5m, 15m, 30m or 1h, so a retry
+// queue isn't declared for every delay. If the consumer has a
+// RetryPolicy its MaxAttempts still applies, once they are used up
+// the message is dead-lettered
+func RetryAfter(d time.Duration, err error) error {
+	return &handlerError{action: actionRetry, delay: d, err: err}
+}
+
+// DeadLetter wraps an error returned from a handler so the message
+// is dead-lettered straight away skipping any retries, use it for
+// poison messages that will never succeed
+func DeadLetter(err error) error {
+	return &handlerError{action: actionDeadLetter, err: err}
+}
+
+// errorAction returns the handlerError wrapped in err if any
+func errorAction(err error) (*handlerError, bool) {
+	var he *handlerError
+	if errors.As(err, &he) {
+		return he, true
+	}
+	return nil, false
+}
+
+// describe returns the action and delay as a string for logging
+func (e *handlerError) describe() string {
+	if e.action == actionRetry {
+		return fmt.Sprintf("%s after %s", e.action, e.delay)
+	}
+	return e.action.String()
+}
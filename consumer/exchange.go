@@ -2,17 +2,20 @@ package consumer
 
 import (
 	"errors"
-	"github.com/streadway/amqp"
 	"fmt"
 	log "github.com/sirupsen/logrus"
 )
 
 const (
 	TOPIC_EXCHANGE = "topic"
+	DIRECT_EXCHANGE = "direct"
+	FANOUT_EXCHANGE = "fanout"
+	HEADERS_EXCHANGE = "headers"
 )
 
 var (
 	ERRNAMEREQUIRED = errors.New("name is a required exchange field")
+	ERRINVALIDEXCHANGETYPE = errors.New("exchange type must be one of topic, direct, fanout or headers")
 )
 
 // Exchange config sets up a new
@@ -20,17 +23,31 @@ var (
 // Defaults are enabled so not all params
 // may need set depending on requirements
 type ExchangeConfig struct{
-	Name string
-	exType *string
-	durable *bool
-	autoDelete *bool
-	internal *bool
-	args map[string]interface{}
+	Name string `json:"name"`
+	// Type is one of the exchange type constants, it
+	// decides how Routes are bound to the exchange
+	Type *string `json:"type"`
+	Durable *bool `json:"durable"`
+	AutoDelete *bool `json:"auto_delete"`
+	Internal *bool `json:"internal"`
+	Args map[string]interface{} `json:"args"`
+	// Bindings bind the exchange to upstream exchanges so messages
+	// published to them are routed through to this exchange too.
+	// The upstream exchanges must already exist
+	Bindings []ExchangeBinding `json:"bindings"`
+	// AlternateExchange names a fanout exchange which receives any
+	// message that can't be routed to a queue, it is declared along
+	// with a queue of the same name to hold the messages
+	AlternateExchange *string `json:"alternate_exchange"`
 }
 
-type BrokerConfig struct{
-	Exchange ExchangeConfig
-	Consumers map[string]ConsumerConfig
+// ExchangeBinding binds an exchange to the Source
+// exchange with each of the Keys, or once with an empty
+// key if there are none as for fanout & headers exchanges
+type ExchangeBinding struct{
+	Source string `json:"source"`
+	Keys []string `json:"keys"`
+	Args map[string]interface{} `json:"args"`
 }
 
 // GetAutoDelete returns the type of deletion policy
@@ -48,8 +65,8 @@ func (e *ExchangeConfig) GetName() (string, error){
 // set in config, if nil then it returns a
 // default of Topic
 func (e *ExchangeConfig) GetType() string{
-	if e.exType != nil{
-		return *e.exType
+	if e.Type != nil{
+		return *e.Type
 	}
 
 	return TOPIC_EXCHANGE
@@ -59,8 +76,8 @@ func (e *ExchangeConfig) GetType() string{
 // set in config, if nil then it returns a
 // default of true
 func (e *ExchangeConfig) GetDurable() bool{
-	if e.durable != nil{
-		return *e.durable
+	if e.Durable != nil{
+		return *e.Durable
 	}
 
 	return true
@@ -70,8 +87,8 @@ func (e *ExchangeConfig) GetDurable() bool{
 // set in config, if nil then it returns a
 // default of false
 func (e *ExchangeConfig) GetAutoDelete() bool{
-	if e.autoDelete != nil{
-		return *e.autoDelete
+	if e.AutoDelete != nil{
+		return *e.AutoDelete
 	}
 
 	return false
@@ -82,8 +99,8 @@ func (e *ExchangeConfig) GetAutoDelete() bool{
 // default value is false meaning external sources
 // can by default publish to this exchange
 func (e *ExchangeConfig) GetInternal() bool{
-	if e.internal != nil{
-		return *e.internal
+	if e.Internal != nil{
+		return *e.Internal
 	}
 
 	return false
@@ -92,32 +109,105 @@ func (e *ExchangeConfig) GetInternal() bool{
 // GetArgs gets a table of arbitrary arguments
 // which are passed to the exchange
 func (e *ExchangeConfig) GetArgs() map[string]interface{}{
-	if e.args == nil{
+	if e.Args == nil{
 		return make(map[string]interface{})
 	}
-	return e.args
+	return e.Args
 }
 
-// BuildExchange builds an exchange
-func (e *ExchangeConfig) BuildExchange(ch *amqp.Channel) (err error){
+// GetDeadletterName returns the name of the exchange
+// messages from the exchange's queues are dead-lettered to
+func (e *ExchangeConfig) GetDeadletterName() string{
+	return fmt.Sprintf("%s.deadletter", e.Name)
+}
+
+// BuildExchange builds an exchange along with its deadletter
+// exchange, which has the same type so queues are bound to it
+// in the same way
+func (e *ExchangeConfig) BuildExchange(ch Channel) (err error){
 	n, err := e.GetName()
 	if err != nil{
 		log.Error(err)
 		return err
 	}
+	if err = e.validateType(); err != nil{
+		log.Error(err)
+		return
+	}
 
 	log.Debugf("setting up %s exchange", n)
 
-	dlx := fmt.Sprintf("%s.deadletter", n)
-	if err = ch.ExchangeDeclare(dlx, e.GetType(), e.GetDurable(), e.GetAutoDelete(), e.GetInternal(), false, nil); err != nil{
-		log.Errorf("error when setting up deadletter exchange %s: %s", dlx)
+	dlx := e.GetDeadletterName()
+	if err = declareConflict(ch.ExchangeDeclare(dlx, e.GetType(), e.GetDurable(), e.GetAutoDelete(), e.GetInternal(), false, nil)); err != nil{
+		log.Errorf("error when setting up deadletter exchange %s: %s", dlx, err)
 		return
 	}
 
-	if err = ch.ExchangeDeclare(n, e.GetType(), e.GetDurable(),e.GetAutoDelete(), e.GetInternal(), false, e.GetArgs()); err != nil{
+	if e.AlternateExchange != nil{
+		if err = buildAlternateExchange(ch, *e.AlternateExchange); err != nil{
+			return
+		}
+	}
+
+	if err = declareConflict(ch.ExchangeDeclare(n, e.GetType(), e.GetDurable(),e.GetAutoDelete(), e.GetInternal(), false, e.declareArgs())); err != nil{
 		log.Errorf("error when setting up exchange %s: %s",n, err.Error())
 		return
 	}
+
+	for _, b := range e.Bindings{
+		keys := b.Keys
+		if len(keys) == 0{
+			keys = []string{""}
+		}
+		for _, k := range keys{
+			log.Debugf("binding exchange %s to %s with key %s", n, b.Source, k)
+			if err = ch.ExchangeBind(n, k, b.Source, false, b.Args); err != nil{
+				log.Errorf("error binding exchange %s to %s with key %s: %s", n, b.Source, k, err)
+				return
+			}
+		}
+	}
 	log.Debugf("%s exchange setup success", n)
 	return
 }
+
+// declareArgs returns a copy of the exchange's args
+// along with its alternate exchange if it has one
+func (e *ExchangeConfig) declareArgs() map[string]interface{}{
+	args := make(map[string]interface{})
+	for k, v := range e.GetArgs(){
+		args[k] = v
+	}
+	if e.AlternateExchange != nil{
+		args["alternate-exchange"] = *e.AlternateExchange
+	}
+	return args
+}
+
+// validateType checks the exchange type is one we can bind queues to
+func (e *ExchangeConfig) validateType() error{
+	switch e.GetType(){
+	case TOPIC_EXCHANGE, DIRECT_EXCHANGE, FANOUT_EXCHANGE, HEADERS_EXCHANGE:
+		return nil
+	}
+	return fmt.Errorf("%w, got %q for exchange %s", ERRINVALIDEXCHANGETYPE, e.GetType(), e.Name)
+}
+
+// buildAlternateExchange declares the alternate exchange
+// and a queue of the same name bound to it
+func buildAlternateExchange(ch Channel, name string) (err error){
+	log.Debugf("setting up alternate exchange %s", name)
+	if err = ch.ExchangeDeclare(name, FANOUT_EXCHANGE, true, false, false, false, nil); err != nil{
+		log.Errorf("error when setting up alternate exchange %s: %s", name, err)
+		return
+	}
+	if _, err = ch.QueueDeclare(name, true, false, false, false, nil); err != nil{
+		log.Errorf("error when setting up alternate exchange queue %s: %s", name, err)
+		return
+	}
+	if err = ch.QueueBind(name, "", name, false, nil); err != nil{
+		log.Errorf("error binding alternate exchange queue %s: %s", name, err)
+		return
+	}
+	return
+}
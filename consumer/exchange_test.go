@@ -0,0 +1,181 @@
+package consumer_test
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/streadway/amqp"
+	"github.com/theflyingcodr/rabbitmq/consumer"
+	"github.com/theflyingcodr/rabbitmq/memory"
+)
+
+func TestRoutesBindings(t *testing.T) {
+	tests := map[string]struct {
+		routes consumer.Routes
+		kind   string
+		want   []consumer.Binding
+		err    string
+	}{
+		"topic binds each key": {
+			routes: consumer.Routes{Keys: []string{"orders.#", "refunds.*"}},
+			kind:   consumer.TOPIC_EXCHANGE,
+			want:   []consumer.Binding{{Key: "orders.#"}, {Key: "refunds.*"}},
+		},
+		"direct binds each key": {
+			routes: consumer.Routes{Keys: []string{"orders.created"}},
+			kind:   consumer.DIRECT_EXCHANGE,
+			want:   []consumer.Binding{{Key: "orders.created"}},
+		},
+		"topic without keys": {
+			routes: consumer.Routes{},
+			kind:   consumer.TOPIC_EXCHANGE,
+			want:   []consumer.Binding{},
+		},
+		"fanout ignores keys": {
+			routes: consumer.Routes{Keys: []string{"a", "b"}},
+			kind:   consumer.FANOUT_EXCHANGE,
+			want:   []consumer.Binding{{Key: ""}},
+		},
+		"headers match all by default": {
+			routes: consumer.Routes{Headers: map[string]interface{}{"region": "eu"}},
+			kind:   consumer.HEADERS_EXCHANGE,
+			want:   []consumer.Binding{{Key: "", Args: amqp.Table{"x-match": "all", "region": "eu"}}},
+		},
+		"headers match any": {
+			routes: consumer.Routes{Headers: map[string]interface{}{"region": "eu", "tier": "gold"}, HeadersMatch: consumer.HeadersMatchAny},
+			kind:   consumer.HEADERS_EXCHANGE,
+			want:   []consumer.Binding{{Key: "", Args: amqp.Table{"x-match": "any", "region": "eu", "tier": "gold"}}},
+		},
+		"headers ignore keys": {
+			routes: consumer.Routes{Keys: []string{"a"}, Headers: map[string]interface{}{"region": "eu"}},
+			kind:   consumer.HEADERS_EXCHANGE,
+			want:   []consumer.Binding{{Key: "", Args: amqp.Table{"x-match": "all", "region": "eu"}}},
+		},
+		"invalid headers match": {
+			routes: consumer.Routes{Headers: map[string]interface{}{"region": "eu"}, HeadersMatch: "some"},
+			kind:   consumer.HEADERS_EXCHANGE,
+			err:    `headers match must be all or any, got "some"`,
+		},
+		"headers on a topic exchange": {
+			routes: consumer.Routes{Headers: map[string]interface{}{"region": "eu"}},
+			kind:   consumer.TOPIC_EXCHANGE,
+			err:    "headers can only be bound to a headers exchange, not topic",
+		},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			got, err := tt.routes.Bindings(tt.kind)
+			if tt.err != "" {
+				if err == nil || err.Error() != tt.err {
+					t.Fatalf("got error %v, want %s", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExchangeConfigType(t *testing.T) {
+	tests := map[string]struct {
+		kind  *string
+		valid bool
+	}{
+		"default":   {kind: nil, valid: true},
+		"topic":     {kind: strp(consumer.TOPIC_EXCHANGE), valid: true},
+		"direct":    {kind: strp(consumer.DIRECT_EXCHANGE), valid: true},
+		"fanout":    {kind: strp(consumer.FANOUT_EXCHANGE), valid: true},
+		"headers":   {kind: strp(consumer.HEADERS_EXCHANGE), valid: true},
+		"empty":     {kind: strp("")},
+		"uppercase": {kind: strp("Topic")},
+		"plugin":    {kind: strp("x-delayed-message")},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			b := memory.NewBroker()
+			conn, err := b.Dial("mem")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			ch, err := conn.Channel()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = (&consumer.ExchangeConfig{Name: "ex", Type: tt.kind}).BuildExchange(ch)
+			if tt.valid {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			if !errors.Is(err, consumer.ERRINVALIDEXCHANGETYPE) {
+				t.Fatalf("got %v, want invalid exchange type", err)
+			}
+			if !strings.Contains(err.Error(), `"`+*tt.kind+`" for exchange ex`) {
+				t.Errorf("%v doesn't name the type & exchange", err)
+			}
+			// nothing is declared for an invalid type
+			if ex := b.Exchanges(); len(ex) != 0 {
+				t.Errorf("declared %v", ex)
+			}
+		})
+	}
+}
+
+func TestBuildExchangeBindingsAndAlternate(t *testing.T) {
+	b := memory.NewBroker()
+	conn, err := b.Dial("mem")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	ch, err := conn.Channel()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the upstream exchanges must already exist
+	if err := ch.ExchangeDeclare("events", consumer.TOPIC_EXCHANGE, true, false, false, false, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := ch.ExchangeDeclare("legacy", consumer.FANOUT_EXCHANGE, true, false, false, false, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	ex := &consumer.ExchangeConfig{
+		Name: "orders",
+		Bindings: []consumer.ExchangeBinding{
+			{Source: "events", Keys: []string{"orders.*"}},
+			{Source: "legacy"},
+		},
+		AlternateExchange: strp("orders.unrouted"),
+	}
+	if err := ex.BuildExchange(ch); err != nil {
+		t.Fatal(err)
+	}
+	r := &consumer.Routes{Keys: []string{"orders.created"}, DeliveryFunc: ack}
+	if err := (&consumer.ConsumerConfig{Name: "created"}).BuildQueue("created", r, ch, ex); err != nil {
+		t.Fatal(err)
+	}
+
+	publish(t, b, "events", "orders.created", 1)
+	publish(t, b, "legacy", "orders.created", 1)
+	// reaches orders but no queue, so goes to the alternate exchange
+	publish(t, b, "events", "orders.cancelled", 1)
+	// isn't bound through to orders at all
+	publish(t, b, "events", "users.created", 1)
+
+	for q, want := range map[string]int{"created": 2, "orders.unrouted": 1} {
+		if s, _ := b.Queue(q); s.Ready != want {
+			t.Errorf("queue %s has %d messages, want %d", q, s.Ready, want)
+		}
+	}
+}
@@ -13,12 +13,140 @@ import (
 	"fmt"
 	"github.com/pborman/uuid"
 	"sync"
+	"sync/atomic"
+	"math/rand"
+	"net/url"
+	"strings"
+)
+
+// Orders a host tries the addresses of a cluster in
+const (
+	// AddressRoundRobin tries each address in turn starting
+	// after the one last connected to, so the node that was
+	// lost is tried last
+	AddressRoundRobin = "round_robin"
+	// AddressRandom tries the addresses in a random order
+	AddressRandom = "random"
 )
 
 // HostConfig contains global config
 // used for the rabbit connection
 type HostConfig struct{
-	Address string
+	Address string `json:"address"`
+	// Addresses lists the nodes of a cluster, the host connects
+	// to one at a time failing over to the next if it can't. Address
+	// is tried along with them if it's set
+	Addresses []string `json:"addresses"`
+	// AddressSelection is the order nodes are tried in, one of
+	// AddressRoundRobin or AddressRandom, defaults to AddressRoundRobin
+	AddressSelection *string `json:"address_selection"`
+	// Dial opens the connection to the broker, if nil
+	// RabbitMq is connected to using TLS & AuthMechanism
+	Dial Dialer `json:"-"`
+	// TLS configures connections to amqps:// addresses, if nil
+	// they're made with the system's certificate authorities
+	TLS *TLSConfig `json:"tls"`
+	// AuthMechanism is how the host authenticates, one of AuthPlain
+	// or AuthExternal, defaults to AuthPlain
+	AuthMechanism *string `json:"auth_mechanism"`
+	// PrefixSeparator joins a consumer's Prefix to
+	// the names of its queues, defaults to "."
+	PrefixSeparator *string `json:"prefix_separator"`
+	// ShutdownTimeout limits how long the host waits for messages
+	// being handled when it stops itself because its context was
+	// cancelled or a queue failed, defaults to 30 seconds
+	ShutdownTimeout *time.Duration `json:"shutdown_timeout"`
+	// Reconnect decides how often the host tries to connect to
+	// the broker and when it gives up, if nil it retries with the
+	// default backoff forever
+	Reconnect *ReconnectPolicy `json:"reconnect"`
+}
+
+// GetAddresses returns Address followed by Addresses
+// without any that are empty or repeated
+func (c *HostConfig) GetAddresses() []string{
+	seen := make(map[string]bool)
+	addrs := make([]string, 0, len(c.Addresses)+1)
+	for _, a := range append([]string{c.Address}, c.Addresses...){
+		if a == "" || seen[a]{
+			continue
+		}
+		seen[a] = true
+		addrs = append(addrs, a)
+	}
+	if len(addrs) == 0{
+		return []string{c.Address}
+	}
+	return addrs
+}
+
+// GetAddressSelection returns the order addresses are tried
+// in, if nil then it returns a default of AddressRoundRobin
+func (c *HostConfig) GetAddressSelection() string{
+	if c.AddressSelection == nil{
+		return AddressRoundRobin
+	}
+	return *c.AddressSelection
+}
+
+// GetDial returns the Dialer set in config, if nil then
+// it returns a default of DialAMQPConfig with AMQPConfig. If
+// that config is invalid the Dialer returns its error
+func (c *HostConfig) GetDial() Dialer{
+	d, err := c.dialer()
+	if err != nil{
+		return func(string) (Connection, error){
+			return nil, err
+		}
+	}
+	return d
+}
+
+// GetAuthMechanism returns the mechanism set in config,
+// if nil then it returns a default of AuthPlain
+func (c *HostConfig) GetAuthMechanism() string{
+	if c.AuthMechanism == nil{
+		return AuthPlain
+	}
+	return *c.AuthMechanism
+}
+
+// GetPrefixSeparator returns the separator set in config,
+// if nil then it returns a default of "."
+func (c *HostConfig) GetPrefixSeparator() string{
+	if c.PrefixSeparator == nil{
+		return "."
+	}
+	return *c.PrefixSeparator
+}
+
+// GetShutdownTimeout returns the timeout set in config,
+// if nil then it returns a default of 30 seconds
+func (c *HostConfig) GetShutdownTimeout() time.Duration{
+	if c.ShutdownTimeout == nil{
+		return 30 * time.Second
+	}
+	return *c.ShutdownTimeout
+}
+
+// GetReconnect returns the reconnect policy set in config,
+// if nil then it returns a policy with the default backoff
+// which never gives up
+func (c *HostConfig) GetReconnect() *ReconnectPolicy{
+	if c.Reconnect == nil{
+		return &ReconnectPolicy{}
+	}
+	return c.Reconnect
+}
+
+// Prefixed returns name with the consumer prefix prepended, if
+// the prefix is empty the name is returned unchanged. The host uses
+// it to name queues, deadletter queues and consumer tags
+func (c *HostConfig) Prefixed(prefix, name string) string{
+	if prefix == ""{
+		return name
+	}
+	return prefix + c.GetPrefixSeparator() + name
 }
 
 // Host is the container which is used
@@ -31,9 +159,18 @@ type Host interface{
 	// AddBroker will register an exchange and n consumers
 	// which will consume from that exchange
 	AddBroker(context.Context, *ExchangeConfig, []Consumer) error
-	// Start will setup all queues and routing keys
-	// assigned to each consumer and then in turn start them
+	// Run starts the host and blocks until it's stopped
+	// or ctx is cancelled, returning why it stopped
 	Run(context.Context) (err error)
+	// Start will setup all queues and routing keys
+	// assigned to each consumer and then in turn start
+	// them, it returns once they're started
+	Start(context.Context) error
+	// Done is closed once the host has stopped
+	Done() <-chan struct{}
+	// Err returns the errors that stopped the host
+	// once Done is closed
+	Err() error
 	// Middleware can be used to implement custom
 	// middleware which gets called before messages
 	// are passed to handlers
@@ -42,19 +179,54 @@ type Host interface{
 	Stop(context.Context) error
 
 	GetConnectionStatus() bool
+	// NotifyConnect registers a listener which is sent the
+	// connection each time the host connects or reconnects
+	NotifyConnect(chan Connection) chan Connection
+	// NotifyReconnect registers a listener which is sent
+	// an event after each attempt to connect
+	NotifyReconnect(chan ReconnectEvent) chan ReconnectEvent
+	// OnError registers a callback for errors which stop
+	// a queue being consumed once the host is running
+	OnError(func(error))
 }
 
 type RabbitHost struct{
 	c *HostConfig
-	connection *amqp.Connection
+	connection Connection
 	exchanges []Exchange
-	channels map[string]*amqp.Channel
+	channels map[string]Channel
+	// tags are the consumer tags for each queue
+	tags map[string]string
+	// offsets is the OffsetStore for streams without one
+	// so they resume after a reconnect
+	offsets OffsetStore
+	// inflight counts the messages being handled
+	inflight atomic.Int64
+	// deliveries tracks the loops handling each queue's
+	// deliveries, they end once the consumer is cancelled
+	// and every message already sent has been handled
+	deliveries *sync.WaitGroup
 	middleware MiddlewareList
 	connectionClose chan *amqp.Error
 	wg *sync.WaitGroup
 	mu *sync.Mutex
 	connected bool
-	shutdown bool
+	// address is the node last connected to
+	address string
+	shutdown atomic.Bool
+	// stopping is closed when Stop is called to
+	// interrupt connect waiting between attempts
+	stopping chan struct{}
+	connectListeners []chan Connection
+	reconnectListeners []chan ReconnectEvent
+	onError func(error)
+	// failures are the errors which stopped the host, failed
+	// signals Run when there's no OnError callback
+	failures []error
+	failed chan struct{}
+	stopOnce *sync.Once
+	stopErr error
+	done chan struct{}
 }
 
 type Exchange struct{
@@ -67,12 +239,19 @@ type Exchange struct{
 func NewConsumerHost(cfg *HostConfig) Host{
 	host := &RabbitHost{
 		exchanges:make([]Exchange, 0),
-		channels:make(map[string]*amqp.Channel),
+		channels:make(map[string]Channel),
+		tags:make(map[string]string),
+		offsets: NewMemoryOffsetStore(),
 		c: cfg,
 		connectionClose:make(chan *amqp.Error),
 		wg: &sync.WaitGroup{},
+		deliveries: &sync.WaitGroup{},
 		connected:false,
 		mu: &sync.Mutex{},
+		failed: make(chan struct{}, 1),
+		stopOnce: &sync.Once{},
+		stopping: make(chan struct{}),
+		done: make(chan struct{}),
 	}
 	go host.connectionLoop()
 	host.connectionClose <- amqp.ErrClosed
@@ -87,182 +266,618 @@ func (h *RabbitHost) AddBroker(ctx context.Context, cfg *ExchangeConfig, consume
 	return nil
 }
 
+// Run starts the host and blocks until it stops, when ctx is
+// cancelled, Stop is called or a queue fails without an OnError
+// callback registered. Setup errors are returned straight away,
+// otherwise the errors that stopped the host are returned.
+// Use WithSignalHandling to stop on SIGINT or SIGTERM
+func (h *RabbitHost) Run(ctx context.Context) (err error){
+	if err = h.Start(ctx); err != nil{
+		return err
+	}
+	<-h.Done()
+	return h.Err()
+}
+
 // Start will setup all queues and routing keys
 // assigned to each consumer and then in turn start them
-func (h *RabbitHost) Run(ctx context.Context) (err error){
-	for h.connection == nil{}
-	ch, err := h.connection.Channel()
+// without blocking. Every exchange & queue is setup before
+// any are consumed, if any fail Start returns a joined error
+// naming each one. Once running, errors which stop a queue
+// being consumed are sent to the OnError callback, or if there
+// isn't one the host is stopped. The host is also stopped when
+// ctx is cancelled, Done is closed once it has stopped. If Start
+// returns an error, including when ctx is cancelled before the host
+// connects, it has been stopped already
+func (h *RabbitHost) Start(ctx context.Context) (err error){
+	for !h.GetConnectionStatus(){
+		select{
+		case <-ctx.Done():
+			return h.abort(ctx.Err())
+		case <-h.failed:
+			// the reconnect policy gave up
+			h.abort()
+			return h.Err()
+		case <-time.After(200 * time.Millisecond):
+		}
+	}
+	ch, err := h.currentConnection().Channel()
 	if err != nil{
 		log.Errorf("error when getting channel from connection: %v", err.Error())
-		return err
+		return h.abort(err)
 	}
+
+	var queues []hostQueue
+	var errs []error
 	for _, b := range h.exchanges {
-		n, err := b.exchange.GetName()
+		if err := b.exchange.BuildExchange(ch); err != nil {
+			errs = append(errs, fmt.Errorf("exchange %s: %w", b.exchange.Name, err))
+			// the broker closes the channel when a declare fails
+			ch.Close()
+			if ch, err = h.currentConnection().Channel(); err != nil{
+				return h.abort(append(errs, err)...)
+			}
+		}
+		qs, err := h.queues(ctx, b)
+		if err != nil{
+			errs = append(errs, err)
+		}
+		queues = append(queues, qs...)
+	}
+	ch.Close() // discard the setup channel
+	if len(errs) > 0{
+		log.Errorf("host setup failed: %s", errors.Join(errs...))
+		return h.abort(errs...)
+	}
+
+	// every queue is declared before any are consumed so a
+	// failure, such as a declare conflict, fails startup
+	channels := make([]Channel, len(queues))
+	for i, q := range queues{
+		if channels[i], err = h.declare(q); err != nil{
+			errs = append(errs, err)
+		}
+	}
+	if len(errs) > 0{
+		for _, ch := range channels{
+			if ch != nil{
+				ch.Close()
+			}
+		}
+		log.Errorf("host setup failed: %s", errors.Join(errs...))
+		return h.abort(errs...)
+	}
+
+	for i, q := range queues{
+		h.wg.Add(1)
+		go h.consume(ctx, q, channels[i])
+
+		// setup the dead letter queue
+		if q.cfg.GetHasDeadletter() {
+			h.wg.Add(1)
+			go h.watchDeadletter(q)
+		}
+	}
+
+	go func(){
+		select{
+		case <-ctx.Done():
+			log.Infof("context done, stopping host")
+		case <-h.failed:
+			log.Errorf("stopping host after a queue failed")
+		case <-h.done:
+			// stopped already
+			return
+		}
+		stopCtx, cancel := context.WithTimeout(context.Background(), h.c.GetShutdownTimeout())
+		defer cancel()
+		h.Stop(stopCtx)
+	}()
+	log.Infof("host started")
+	return nil
+}
+
+// abort stops the host when Start fails so it doesn't keep
+// connecting in the background and Done is closed, errs are
+// returned joined with any error stopping
+func (h *RabbitHost) abort(errs ...error) error{
+	ctx, cancel := context.WithTimeout(context.Background(), h.c.GetShutdownTimeout())
+	defer cancel()
+	return errors.Join(append(errs, h.Stop(ctx))...)
+}
+
+// Done returns a channel that's closed once the host has stopped
+func (h *RabbitHost) Done() <-chan struct{}{
+	return h.done
+}
+
+// Err returns the errors that stopped the host joined together, along
+// with any error closing the connection. It's nil until Done is closed
+func (h *RabbitHost) Err() error{
+	select{
+	case <-h.done:
+	default:
+		return nil
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return errors.Join(append(append([]error{}, h.failures...), h.stopErr)...)
+}
+
+// WithSignalHandling returns a copy of ctx which is cancelled when
+// the process receives SIGINT or SIGTERM, passing it to Run stops
+// the host gracefully on ctrl+c. Calling stop releases the signals
+func WithSignalHandling(ctx context.Context) (c context.Context, stop context.CancelFunc){
+	return signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+}
+
+// QueueError is returned when a queue couldn't be
+// setup or consumed, naming the exchange & queue
+type QueueError struct{
+	Exchange string
+	Queue string
+	Err error
+}
+
+func (e *QueueError) Error() string{
+	return fmt.Sprintf("exchange %s queue %s: %s", e.Exchange, e.Queue, e.Err)
+}
+
+func (e *QueueError) Unwrap() error{
+	return e.Err
+}
+
+// hostQueue is a queue the host consumes from along
+// with the exchange & consumer it belongs to
+type hostQueue struct{
+	exchange *ExchangeConfig
+	consumer Consumer
+	prefix string
+	// name is the queue name with the consumer prefix
+	name string
+	routes *Routes
+	// cfg is the consumer config merged with the queue's
+	cfg *ConsumerConfig
+}
+
+func (q hostQueue) error(err error) error{
+	return &QueueError{Exchange: q.exchange.Name, Queue: q.name, Err: err}
+}
+
+// queues initialises the exchange's consumers and checks the config
+// of each of their queues, errors for every consumer & queue are joined
+func (h *RabbitHost) queues(ctx context.Context, b Exchange) ([]hostQueue, error){
+	var queues []hostQueue
+	var errs []error
+	for _, c := range b.consumers {
+		cfg, err := c.Init()
 		if err != nil {
-			log.Error(err)
-			return err
+			errs = append(errs, fmt.Errorf("exchange %s: consumer init failed: %w", b.exchange.Name, err))
+			continue
+		}
+		if cfg == nil {
+			cfg = &ConsumerConfig{}
+		}
+
+		// fix the name before merging so queues
+		// without their own share the consumer's
+		cfg.GetName()
+		prefix := c.Prefix()
+		for k, r := range c.Queues(ctx){
+			q := hostQueue{
+				exchange: b.exchange,
+				consumer: c,
+				prefix: prefix,
+				name: h.c.Prefixed(prefix, k),
+				routes: r,
+				// queue config overrides the consumer's
+				cfg: cfg.Merge(r.Config),
+			}
+			if err := q.cfg.Validate(); err != nil {
+				errs = append(errs, q.error(err))
+				continue
+			}
+			if q.cfg.OffsetStore == nil{
+				q.cfg.OffsetStore = h.offsets
+			}
+			if _, err := r.Bindings(b.exchange.GetType()); err != nil {
+				errs = append(errs, q.error(err))
+				continue
+			}
+			queues = append(queues, q)
+		}
+	}
+	return queues, errors.Join(errs...)
+}
+
+// declare declares the queue and its deadletter queue, returning
+// the channel the queue was declared on for consume to use
+func (h *RabbitHost) declare(q hostQueue) (Channel, error){
+	conn := h.currentConnection()
+	ch, err := q.cfg.DeclareQueue(q.name, q.routes, conn, q.exchange)
+	if err != nil{
+		return nil, q.error(err)
+	}
+	if !q.cfg.GetHasDeadletter(){
+		return ch, nil
+	}
+
+	dlq := h.c.Prefixed(q.prefix, q.cfg.GetDeadletterName())
+	dlCh, err := conn.Channel()
+	if err == nil{
+		err = q.cfg.BuildDeadletterQueue(dlq, q.routes, dlCh, conn, q.exchange)
+	}
+	if err != nil{
+		ch.Close()
+		return nil, &QueueError{Exchange: q.exchange.Name, Queue: dlq, Err: err}
+	}
+	return ch, nil
+}
+
+// consume consumes from the queue Start declared on queueChannel,
+// redeclaring it on a new channel each time the channel closes until
+// the host is shutdown. Errors that redeclaring won't fix are
+// reported with fail
+func (h *RabbitHost) consume(ctx context.Context, q hostQueue, queueChannel Channel){
+	defer h.wg.Done()
+	defer flushOffsets(q.cfg, q.name)
+
+	for ; ; queueChannel = nil {
+		// we're in the middle of shutdown, exit
+		if h.shutdown.Load(){
+			if queueChannel != nil{
+				queueChannel.Close()
+			}
+			return
+		}
+		if queueChannel == nil{
+			// wait until we have a connection
+			if !h.GetConnectionStatus() {
+				time.Sleep(200 * time.Millisecond)
+				continue
+			}
+
+			// build the queue on a new channel, if it's deleted it will be recreated
+			var err error
+			queueChannel, err = q.cfg.DeclareQueue(q.name, q.routes, h.currentConnection(), q.exchange)
+			if refused(err) || errors.Is(err, ERRINVALIDQUEUECONFIG){
+				h.fail(q.error(err))
+				return
+			}
+			if err != nil{
+				log.Errorf("error setting up consumer queue for %s: %s", q.name, err)
+				time.Sleep(500 *time.Millisecond)
+				continue
+			}
+		}
+
+		h.mu.Lock()
+		h.channels[q.name] = queueChannel
+		h.mu.Unlock()
+
+		// buffered so the channel isn't blocked
+		// closing if we stop consuming from it
+		closeChannel := make(chan *amqp.Error, 1)
+		cancelChannel := make(chan string, 1)
+		queueChannel.NotifyClose(closeChannel)
+		queueChannel.NotifyCancel(cancelChannel)
+
+		// retries are confirmed before the delivery is acked
+		retryChannel, err := newConfirmedChannel(queueChannel)
+		if err != nil{
+			h.stopConsuming(q, queueChannel)
+			if h.shutdown.Load(){
+				return
+			}
+			log.Errorf("error setting up retries for queue %s: %s", q.name, err)
+			continue
+		}
+
+		// start consuming messages
+		tag := fmt.Sprintf("%s-%s", h.c.Prefixed(q.prefix, q.cfg.GetName()), uuid.New())
+		// streams resume after the last offset handled
+		args, err := q.cfg.consumeArgs(ctx, q.name)
+		if err != nil{
+			h.stopConsuming(q, queueChannel)
+			h.fail(q.error(err))
+			return
+		}
+		msgs, err := queueChannel.Consume(q.name, tag, false, q.cfg.GetExclusive(), false, q.cfg.GetNoWait(), args)
+		if err == nil{
+			h.mu.Lock()
+			if h.shutdown.Load(){
+				// Stop has already cancelled the other consumers
+				h.mu.Unlock()
+				h.stopConsuming(q, queueChannel)
+				return
+			}
+			h.tags[q.name] = tag
+			// added under the lock so Stop can't be waiting already
+			h.deliveries.Add(1)
+			h.mu.Unlock()
+		}
+		if err != nil{
+			h.stopConsuming(q, queueChannel)
+			if h.shutdown.Load(){
+				return
+			}
+			if refused(err){
+				h.fail(q.error(err))
+				return
+			}
+			log.Errorf("error consuming from queue %s: %s", q.name, err)
+			continue
 		}
-		b.exchange.BuildExchange(ch)
 
+		// setup global, consumer & default middleware
+		dlx := ""
+		if q.cfg.GetHasDeadletter() {
+			dlx = q.exchange.GetDeadletterName()
+		}
+		retrier := NewRetrier(q.name, dlx, q.cfg, retryChannel)
+		handler := trackOffset(q.cfg, q.name, Chain(q.consumer, q.routes, h.middleware, retrier))
+		// not part of wg, Stop waits for in flight
+		// messages only until its deadline
 		go func() {
-			for _, c := range b.consumers {
-				cfg, err := c.Init()
-				if err != nil {
-					log.Fatal(err)
+			defer h.deliveries.Done()
+			// msgs is closed once the consumer is cancelled and
+			// the messages the client had buffered are handled
+			for d := range msgs {
+				h.inflight.Add(1)
+				handler.HandleMessage(context.Background(), d)
+				h.inflight.Add(-1)
+			}
+		}()
+
+		select {
+			case queueErr := <-closeChannel:
+				if h.shutdown.Load(){
+					// indicates a graceful shutdown
+					// exit the routine
+					return
+				} else if queueErr != nil{
+					// there was an error, usually due to connection being closed
+					// log it and then we attempt to recreate the channel & queue
+					log.Errorf("queue channel closed for queue %s: %s", q.name, queueErr.Error())
 				}
-				if cfg == nil {
-					cfg = &ConsumerConfig{}
+			case <-cancelChannel:
+				if h.shutdown.Load() {
+					return
 				}
+				log.Infof("channel for queue %s deleted, recreating", q.name)
+		}
+		h.mu.Lock()
+		delete(h.channels, q.name)
+		delete(h.tags, q.name)
+		h.mu.Unlock()
+	}
+}
 
+// stopConsuming closes the queue's channel and forgets it
+func (h *RabbitHost) stopConsuming(q hostQueue, ch Channel){
+	ch.Close()
+	h.mu.Lock()
+	delete(h.channels, q.name)
+	delete(h.tags, q.name)
+	h.mu.Unlock()
+}
 
-				for k, r := range c.Queues(ctx){
-					go func(key string, routes *Routes) {
-						h.wg.Add(1)
-						defer h.wg.Done()
-
-						for {
-							// wait until we have a connection
-							if !h.connected {
-								time.Sleep(200 * time.Millisecond)
-								continue
-							}
-
-							// attempt to get a channel
-							queueChannel, err := h.connection.Channel()
-							if err != nil{
-								log.Error("error setting up consumer queue for %s", key)
-								time.Sleep(500 *time.Millisecond)
-								continue
-							}
-
-							h.mu.Lock()
-							h.channels[key] = queueChannel
-							h.mu.Unlock()
-
-							closeChannel := make(chan *amqp.Error)
-							cancelChannel := make(chan string)
-							queueChannel.NotifyClose(closeChannel)
-							queueChannel.NotifyCancel(cancelChannel)
-
-							// build the queue, if it's deleted it will be recreated
-							cfg.BuildQueue(key, routes, queueChannel, n)
-
-							// start consuming
-							go func() {
-								h.wg.Add(1)
-								defer h.wg.Done()
-								// start consuming messages
-								msgs, err := queueChannel.Consume(key, fmt.Sprintf("%s-%s", cfg.GetName(), uuid.NewUUID()), false, cfg.GetExclusive(), false, cfg.GetNoWait(), cfg.Args)
-								if err != nil {
-									log.Fatal(err)
-								}
-
-								// setup global, consumer & default middleware
-								middleware := h.buildChain(c.Middleware(errorHandler(routes.DeliveryFunc)), h.middleware)
-								for d := range msgs {
-									panicHandler(middleware).HandleMessage(context.Background(), d)
-								}
-							}()
-
-							select {
-								case queueErr := <-closeChannel:
-									if h.shutdown{
-										// indicates a graceful shutdown
-										// exit the routine
-										return
-									} else if queueErr != nil{
-										// there was an error, usually due to connection being closed
-										// log it and then we attempt to recreate the channel & queue
-										log.Errorf("queue channel closed for queue %s: %s", k, queueErr.Error())
-									}
-								case <-cancelChannel:
-									if h.shutdown {
-										return
-									}
-									log.Infof("channel for queue %s deleted, recreating", k)
-							}
-							h.mu.Lock()
-							delete(h.channels, key)
-							h.mu.Unlock()
-						}
-					}(k, r)
-
-					// setup the dead letter queue
-					if cfg.GetHasDeadletter() {
-						// check queue every second to check it hasn't been deleted,
-						// recreate it if we can
-						go func(key string, routes *Routes){
-							h.wg.Add(1)
-							defer h.wg.Done()
-							for {
-								// we're in the middle of shutdown, exit
-								if h.shutdown{
-									return
-								}
-								// wait for connection
-								for !h.connected{
-									time.Sleep(200 *time.Millisecond)
-								}
-
-								t := time.NewTimer(time.Second)
-								<-t.C
-
-								dlCh, err := h.connection.Channel()
-								if err != nil{
-									log.Error(err)
-									time.Sleep(200 *time.Millisecond)
-									break
-								}
-								if err := cfg.BuildDeadletterQueue(routes, dlCh, h.connection, n); err != nil{
-									log.Error(err)
-								}
-								t.Reset(time.Second)
-							}
-						}(k, r)
-					}
-				}
-			}
-		}()
+// refused reports whether err is the broker refusing a request on
+// a channel, such as a declare conflict or an exclusive queue in use,
+// which won't succeed by trying again. Connection errors are retried
+func refused(err error) bool{
+	var e *amqp.Error
+	return errors.As(err, &e) && e.Server && e.Recover
+}
+
+// watchDeadletter checks the deadletter queue every second
+// to check it hasn't been deleted, recreating it if we can
+func (h *RabbitHost) watchDeadletter(q hostQueue){
+	defer h.wg.Done()
+	dlq := h.c.Prefixed(q.prefix, q.cfg.GetDeadletterName())
+	for {
+		// we're in the middle of shutdown, exit
+		if h.shutdown.Load(){
+			return
+		}
+		// wait for connection
+		if !h.GetConnectionStatus(){
+			time.Sleep(200 *time.Millisecond)
+			continue
+		}
+
+		t := time.NewTimer(time.Second)
+		<-t.C
+
+		dlCh, err := h.currentConnection().Channel()
+		if err != nil{
+			log.Error(err)
+			time.Sleep(200 *time.Millisecond)
+			continue
+		}
+		if err := q.cfg.BuildDeadletterQueue(dlq, q.routes, dlCh, h.currentConnection(), q.exchange); err != nil{
+			log.Error(err)
+		}
 	}
+}
 
-	ch.Close() // discard the setup channel
-	log.Infof("host started")
-	c := make(chan os.Signal, 2)
-	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
-	<-c
+// fail reports an error which stopped a queue being consumed, it's
+// passed to the OnError callback if there is one, otherwise it's
+// recorded for Run to return and the host is stopped
+func (h *RabbitHost) fail(err error){
+	log.Error(err)
+	h.mu.Lock()
+	fn := h.onError
+	h.mu.Unlock()
 
-	return h.Stop( ctx)
+	if fn != nil{
+		// called on its own goroutine so fn can call Stop
+		go fn(err)
+		return
+	}
+	h.terminate(err)
+}
+
+// terminate records err for Run to return and stops the host
+func (h *RabbitHost) terminate(err error){
+	h.mu.Lock()
+	h.failures = append(h.failures, err)
+	h.mu.Unlock()
+	select{
+	case h.failed <- struct{}{}:
+	default:
+	}
+}
+
+// OnError registers fn to be called with errors that stop a queue
+// being consumed once Run has set it up, the host keeps consuming
+// its other queues. If no callback is registered the host is stopped
+// and Run returns the errors
+func (h *RabbitHost) OnError(fn func(error)){
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.onError = fn
 }
 
 func (h *RabbitHost) Middleware(fn ...HostMiddleware) {
 	h.middleware = append(h.middleware, fn...)
 }
 
-func (h *RabbitHost) Stop(context.Context) error{
-	log.Infof("shutting down host")
-	h.shutdown = true
-	h.connected = false
-	h.mu.Lock()
-	for k, v := range h.channels{
-		log.Infof("closing channel %s", k)
-		if err := v.Close(); err != nil{
-			log.Errorf("error when closing channel %s: %s",k, err)
-			continue
+// Stop cancels every consumer so no more messages are delivered, waits
+// until ctx is done for the messages already received to be handled,
+// then closes the channels & connection and closes Done. If ctx is done
+// first a *DrainError is returned with the number of messages still in
+// flight, the rest are requeued by the broker. Calling it again returns
+// the same result without waiting
+func (h *RabbitHost) Stop(ctx context.Context) error{
+	h.stopOnce.Do(func(){
+		log.Infof("shutting down host")
+		h.shutdown.Store(true)
+		close(h.stopping)
+		h.mu.Lock()
+		for k, tag := range h.tags{
+			log.Infof("cancelling consumer for queue %s", k)
+			if err := h.channels[k].Cancel(tag, false); err != nil{
+				log.Errorf("error when cancelling consumer for queue %s: %s", k, err)
+			}
 		}
-		log.Infof("channel for queue %s closed successfully", k)
-	}
-	h.mu.Unlock()
-	h.wg.Wait()
+		h.mu.Unlock()
+		errs := []error{h.drain(ctx)}
+
+		h.mu.Lock()
+		h.connected = false
+		for k, v := range h.channels{
+			log.Infof("closing channel %s", k)
+			if err := v.Close(); err != nil{
+				log.Errorf("error when closing channel %s: %s",k, err)
+				continue
+			}
+			log.Infof("channel for queue %s closed successfully", k)
+		}
+		h.mu.Unlock()
+		h.wg.Wait()
+
+		if conn := h.currentConnection(); conn != nil{
+			// the connection is already closed if
+			// the host gave up reconnecting
+			if err := conn.Close(); !errors.Is(err, amqp.ErrClosed){
+				errs = append(errs, err)
+			}
+		}
+		h.mu.Lock()
+		h.stopErr = errors.Join(errs...)
+		h.mu.Unlock()
+		close(h.done)
+		log.Infof("shutdown completed")
+	})
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.stopErr
+}
+
+// DrainError is returned by Stop when its context is done
+// before the messages being handled have finished
+type DrainError struct{
+	// InFlight is the number of messages still being handled
+	InFlight int
+	Err error
+}
+
+func (e *DrainError) Error() string{
+	return fmt.Sprintf("stopped with %d messages in flight: %s", e.InFlight, e.Err)
+}
 
-	err := h.connection.Close()
-	log.Infof("shutdown completed")
-	return err
+// Unwrap returns the context's error
+func (e *DrainError) Unwrap() error{
+	return e.Err
+}
+
+// drain waits until the delivery loop of every cancelled consumer
+// has ended, so messages the client received before the cancel are
+// handled too. If ctx is done first a *DrainError is returned
+func (h *RabbitHost) drain(ctx context.Context) error{
+	done := make(chan struct{})
+	go func(){
+		h.deliveries.Wait()
+		close(done)
+	}()
+	select{
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		n := h.inflight.Load()
+		log.Warnf("shutdown deadline reached with %d messages in flight", n)
+		return &DrainError{InFlight: int(n), Err: ctx.Err()}
+	}
 }
 
 func (h *RabbitHost) GetConnectionStatus() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
 	return h.connected
 }
 
+// currentConnection returns the connection last
+// established by connect
+func (h *RabbitHost) currentConnection() Connection {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.connection
+}
+
+// NotifyConnect registers a listener which is sent the connection
+// each time the host connects or reconnects to the broker, if the host
+// is already connected the current connection is sent straight away.
+// Sends don't block so the channel should be buffered, if it's full
+// the connection waiting in it is replaced with the latest
+func (h *RabbitHost) NotifyConnect(c chan Connection) chan Connection {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.connectListeners = append(h.connectListeners, c)
+	if h.connected && h.connection != nil {
+		sendConnection(c, h.connection)
+	}
+	return c
+}
+
+// sendConnection sends conn to l without blocking, if l is full the
+// connection waiting in it is older so it's replaced with conn
+func sendConnection(l chan Connection, conn Connection) {
+	for i := 0; i < 2; i++ {
+		select {
+		case l <- conn:
+			return
+		default:
+		}
+		select {
+		case <-l:
+		default:
+		}
+	}
+	log.Errorf("connection listener is full, dropped connect notification")
+}
+
 // panicHandler intercepts panics from a consumer, logs
 // the error and stack trace then nacks the message
 func panicHandler(h HandlerFunc) HandlerFunc{
@@ -292,17 +907,37 @@ func panicHandler(h HandlerFunc) HandlerFunc{
 
 // errorHandler performs two functions
 // it handles an error and returns an Ack if nil or a
-// nack if err is not nil
+// nack if err is not nil, if a Retrier is provided failed
+// messages are sent to it for retry instead. Errors wrapped
+// with Requeue, Discard, RetryAfter or DeadLetter are
+// settled as they request
 // It also converts a KeyHandlerFunc to a HandlerFunc
 // so middleware can be chained
-func errorHandler(h KeyHandlerFunc) HandlerFunc{
+func errorHandler(h KeyHandlerFunc, r *Retrier) HandlerFunc{
 	return func(ctx context.Context, d amqp.Delivery){
 		err := h(ctx, d)
-		if err != nil {
+		if err == nil {
+			d.Ack(false)
+			return
+		}
+
+		he, ok := errorAction(err)
+		if !ok {
 			log.Infof("error sending message with key %s and correlationid %v. Error: %s", d.RoutingKey, d.CorrelationId, err.Error())
-			d.Nack(false, false)
-		} else{
+			r.fail(d)
+			return
+		}
+
+		log.Infof("error sending message with key %s and correlationid %v, handler requested %s. Error: %s", d.RoutingKey, d.CorrelationId, he.describe(), err.Error())
+		switch he.action {
+		case actionRequeue:
+			d.Nack(false, true)
+		case actionDiscard:
 			d.Ack(false)
+		case actionRetry:
+			r.retryAfter(d, he.delay)
+		default:
+			r.deadLetter(d)
 		}
 	}
 }
@@ -311,50 +946,193 @@ type HostMiddleware func(handler HandlerFunc) HandlerFunc
 
 type MiddlewareList []HostMiddleware
 
-func (h *RabbitHost) connect(){
-	for {
-		conn, err := amqp.Dial(h.c.Address)
+// connect dials the broker until it connects, trying each address
+// in turn and waiting as set by the reconnect policy once they've all
+// failed. If the policy gives up an error wrapping
+// ERRRECONNECTEXHAUSTED is returned. Invalid TLS or auth
+// config is returned straight away as retrying can't fix it.
+// Once Stop is called it gives up returning errShutdown
+func (h *RabbitHost) connect() error{
+	dial, err := h.c.dialer()
+	if err != nil{
+		log.Error(err)
+		return err
+	}
+	p := h.c.GetReconnect()
+	addrs := h.addressOrder(h.c.GetAddresses())
+	start := time.Now()
+	for attempt := 1; ; attempt++ {
+		if h.shutdown.Load(){
+			return errShutdown
+		}
+		addr := addrs[(attempt-1) % len(addrs)]
+		conn, err := dial(addr)
+		e := ReconnectEvent{Address: addr, Attempt: attempt, Elapsed: time.Since(start)}
 
 		if err == nil {
+			h.mu.Lock()
+			// checked under the lock as Stop closes the connection
+			// it finds, one set after that would never be closed
+			if h.shutdown.Load(){
+				h.mu.Unlock()
+				conn.Close()
+				return errShutdown
+			}
 			h.connected = true
 			h.connection = conn
-			log.Infof("connected to %s successful\n", h.c.Address)
-			break
+			h.address = addr
+			for _, l := range h.connectListeners {
+				sendConnection(l, conn)
+			}
+			h.mu.Unlock()
+			h.notifyReconnect(e)
+			log.Infof("connected to %s successful\n", redact(addr))
+			return nil
 		}
 
-		log.Error(err)
-		log.Infof("Trying to reconnect to RabbitMQ at %s\n", h.c.Address)
-		time.Sleep(200 * time.Millisecond)
+		// fail over to the next address straight
+		// away, backing off once they've all failed
+		if attempt % len(addrs) == 0{
+			e.Delay = p.Delay(attempt / len(addrs))
+		}
+		if p.exhausted(attempt, e.Elapsed+e.Delay){
+			e.Delay = 0
+			e.Err = fmt.Errorf("%w, couldn't connect to %s after %d attempts in %s: %w",
+				ERRRECONNECTEXHAUSTED, strings.Join(redactAll(addrs), ", "), attempt, e.Elapsed.Round(time.Millisecond), err)
+			log.Error(e.Err)
+			h.notifyReconnect(e)
+			return e.Err
+		}
+
+		e.Err = err
+		log.Errorf("error connecting to %s: %s", redact(addr), err)
+		next := addrs[attempt % len(addrs)]
+		log.Infof("Trying to reconnect to RabbitMQ at %s in %s, attempt %d\n", redact(next), e.Delay.Round(time.Millisecond), attempt+1)
+		h.notifyReconnect(e)
+		select{
+		case <-time.After(e.Delay):
+		case <-h.stopping:
+			return errShutdown
+		}
 	}
 }
 
-func (h *RabbitHost) connectionLoop() {
-	var rabbitErr *amqp.Error
+// addressOrder returns the order to try the addresses in
+func (h *RabbitHost) addressOrder(addrs []string) []string{
+	order := make([]string, 0, len(addrs))
+	if h.c.GetAddressSelection() == AddressRandom{
+		for _, i := range rand.Perm(len(addrs)){
+			order = append(order, addrs[i])
+		}
+		return order
+	}
 
+	h.mu.Lock()
+	last := h.address
+	h.mu.Unlock()
+	first := 0
+	for i, a := range addrs{
+		if a == last{
+			first = i + 1
+		}
+	}
+	for i := range addrs{
+		order = append(order, addrs[(first+i) % len(addrs)])
+	}
+	return order
+}
+
+// redact hides the password in an address so it can be logged
+func redact(address string) string{
+	u, err := url.Parse(address)
+	if err != nil{
+		return address
+	}
+	return u.Redacted()
+}
+
+func redactAll(addrs []string) []string{
+	r := make([]string, len(addrs))
+	for i, a := range addrs{
+		r[i] = redact(a)
+	}
+	return r
+}
+
+// NotifyReconnect registers a listener which is sent an event after
+// each attempt to connect to the broker, whether it failed or not.
+// Sends don't block so the channel should be buffered
+func (h *RabbitHost) NotifyReconnect(c chan ReconnectEvent) chan ReconnectEvent {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.reconnectListeners = append(h.reconnectListeners, c)
+	return c
+}
+
+func (h *RabbitHost) notifyReconnect(e ReconnectEvent){
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, l := range h.reconnectListeners {
+		select {
+		case l <- e:
+		default:
+			log.Errorf("reconnect listener is full, dropped reconnect notification")
+		}
+	}
+}
+
+func (h *RabbitHost) connectionLoop() {
 	for {
-		rabbitErr = <-h.connectionClose
+		rabbitErr, ok := <-h.connectionClose
+		if !ok {
+			if h.shutdown.Load() {
+				// the connection was closed gracefully
+				return
+			}
+			// the connection closed before we started listening
+			rabbitErr = amqp.ErrClosed
+		}
 		if rabbitErr != nil {
-			log.Errorf("connection lost %s", rabbitErr.Error())
+			h.mu.Lock()
 			h.connected = false
-			log.Infof("connecting to %s\n", h.c.Address)
+			lost := h.address
+			h.mu.Unlock()
+			if lost != ""{
+				log.Errorf("connection to %s lost %s", redact(lost), rabbitErr.Error())
+			} else {
+				log.Errorf("connection lost %s", rabbitErr.Error())
+			}
+			log.Infof("connecting to %s\n", strings.Join(redactAll(h.c.GetAddresses()), ", "))
 
-			h.connect()
-			h.connectionClose = make(chan *amqp.Error)
-			for h.connection == nil {
-				time.Sleep(200 *time.Millisecond)
+			if err := h.connect(); err != nil{
+				if !errors.Is(err, errShutdown){
+					h.terminate(err)
+				}
+				return
 			}
-			h.connection.NotifyClose(h.connectionClose)
+			h.connectionClose = make(chan *amqp.Error)
+			h.currentConnection().NotifyClose(h.connectionClose)
 		}
 	}
 }
 
 
+// Chain builds the handler that processes deliveries for a set of
+// routes. The routes DeliveryFunc is converted by the errorHandler, then
+// wrapped by the consumer's middleware followed by the host middleware,
+// with the panicHandler outermost. If r is nil failed messages
+// are dead-lettered and RetryAfter errors can't be honoured
+func Chain(c Consumer, routes *Routes, m MiddlewareList, r *Retrier) HandlerFunc {
+	return panicHandler(restoreRouting(buildChain(c.Middleware(errorHandler(routes.DeliveryFunc, r)), m)))
+}
+
 // buildChain builds the middleware chain recursively, functions are first class
-func (h *RabbitHost) buildChain(f HandlerFunc, m MiddlewareList) HandlerFunc {
+func buildChain(f HandlerFunc, m MiddlewareList) HandlerFunc {
 	// if our chain is done, use the original handlerfunc
 	if len(m) == 0 {
 		return f
 	}
 	// otherwise nest the handlerfuncs
-	return m[0](h.buildChain(f, m[1:cap(m)]))
+	return m[0](buildChain(f, m[1:]))
 }
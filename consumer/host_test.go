@@ -0,0 +1,350 @@
+package consumer_test
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/streadway/amqp"
+	"github.com/theflyingcodr/rabbitmq/consumer"
+	"github.com/theflyingcodr/rabbitmq/memory"
+)
+
+// testConsumer consumes a single queue bound with key
+type testConsumer struct {
+	cfg     *consumer.ConsumerConfig
+	queue   string
+	key     string
+	handler consumer.KeyHandlerFunc
+}
+
+func (c *testConsumer) Init() (*consumer.ConsumerConfig, error) { return c.cfg, nil }
+func (c *testConsumer) Prefix() string                          { return "" }
+func (c *testConsumer) Middleware(h consumer.HandlerFunc) consumer.HandlerFunc {
+	return h
+}
+func (c *testConsumer) Queues(ctx context.Context) map[string]*consumer.Routes {
+	return map[string]*consumer.Routes{
+		c.queue: {Keys: []string{c.key}, DeliveryFunc: c.handler},
+	}
+}
+
+func startHost(t *testing.T, b *memory.Broker, c consumer.Consumer) consumer.Host {
+	t.Helper()
+	h := consumer.NewConsumerHost(&consumer.HostConfig{Address: "mem", Dial: b.Dial})
+	h.AddBroker(context.Background(), &consumer.ExchangeConfig{Name: "ex"}, []consumer.Consumer{c})
+	if err := h.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { h.Stop(context.Background()) })
+	return h
+}
+
+// waitFor polls fn until it's true or a second has passed
+func waitFor(t *testing.T, what string, fn func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(time.Second); !fn(); {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func publish(t *testing.T, b *memory.Broker, exchange, key string, n int) {
+	t.Helper()
+	conn, err := b.Dial("mem")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	ch, err := conn.Channel()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < n; i++ {
+		if err := ch.Publish(exchange, key, false, false, amqp.Publishing{Body: []byte("m")}); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func slowConsumer(delay time.Duration, handled *atomic.Int64) *testConsumer {
+	prefetch := uint(5)
+	return &testConsumer{
+		cfg:   &consumer.ConsumerConfig{Name: "slow", PrefetchCount: &prefetch},
+		queue: "slow",
+		key:   "s",
+		handler: func(ctx context.Context, d amqp.Delivery) error {
+			time.Sleep(delay)
+			handled.Add(1)
+			return nil
+		},
+	}
+}
+
+func TestStopHandlesPrefetchedMessages(t *testing.T) {
+	b := memory.NewBroker()
+	var handled atomic.Int64
+	h := startHost(t, b, slowConsumer(50*time.Millisecond, &handled))
+	waitFor(t, "consumer", func() bool {
+		q, _ := b.Queue("slow")
+		return q.Consumers == 1
+	})
+	publish(t, b, "ex", "s", 3)
+	waitFor(t, "deliveries", func() bool {
+		q, _ := b.Queue("slow")
+		return q.Unacked == 3
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := h.Stop(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if n := handled.Load(); n != 3 {
+		t.Fatalf("handled %d messages, want 3", n)
+	}
+	q, _ := b.Queue("slow")
+	if q.Ready != 0 || q.Unacked != 0 {
+		t.Fatalf("queue %+v, want every message acked", q)
+	}
+	select {
+	case <-h.Done():
+	default:
+		t.Fatal("done not closed")
+	}
+}
+
+func TestStopReportsInFlightOnTimeout(t *testing.T) {
+	b := memory.NewBroker()
+	var handled atomic.Int64
+	h := startHost(t, b, slowConsumer(time.Second, &handled))
+	waitFor(t, "consumer", func() bool {
+		q, _ := b.Queue("slow")
+		return q.Consumers == 1
+	})
+	publish(t, b, "ex", "s", 3)
+	waitFor(t, "deliveries", func() bool {
+		q, _ := b.Queue("slow")
+		return q.Unacked == 3
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	err := h.Stop(ctx)
+	var de *consumer.DrainError
+	if !errors.As(err, &de) || de.InFlight != 1 || !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("got %v, want a DrainError with 1 message in flight", err)
+	}
+	q, _ := b.Queue("slow")
+	if q.Ready != 3 {
+		t.Fatalf("queue %+v, want the messages requeued", q)
+	}
+}
+
+func TestNotifyConnectSendsLatestConnection(t *testing.T) {
+	b := memory.NewBroker()
+	var mu sync.Mutex
+	var last consumer.Connection
+	initial := 10 * time.Millisecond
+	h := consumer.NewConsumerHost(&consumer.HostConfig{
+		Address: "mem",
+		Dial: func(address string) (consumer.Connection, error) {
+			conn, err := b.Dial(address)
+			mu.Lock()
+			defer mu.Unlock()
+			if err == nil {
+				last = conn
+			}
+			return conn, err
+		},
+		Reconnect: &consumer.ReconnectPolicy{InitialDelay: &initial},
+	})
+	t.Cleanup(func() { h.Stop(context.Background()) })
+	waitFor(t, "connection", h.GetConnectionStatus)
+	conns := h.NotifyConnect(make(chan consumer.Connection, 1))
+
+	// nothing reads the listener while the host reconnects twice
+	for i := 0; i < 2; i++ {
+		mu.Lock()
+		previous := last
+		mu.Unlock()
+		b.Disconnect()
+		waitFor(t, "reconnect", func() bool {
+			mu.Lock()
+			defer mu.Unlock()
+			return last != previous && h.GetConnectionStatus()
+		})
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if conn := <-conns; conn != last {
+		t.Fatal("listener was sent an old connection")
+	}
+}
+
+// routesConsumer consumes each of its routes with the prefix
+type routesConsumer struct {
+	prefix string
+	cfg    *consumer.ConsumerConfig
+	routes map[string]*consumer.Routes
+}
+
+func (c *routesConsumer) Init() (*consumer.ConsumerConfig, error) { return c.cfg, nil }
+func (c *routesConsumer) Prefix() string                          { return c.prefix }
+func (c *routesConsumer) Middleware(h consumer.HandlerFunc) consumer.HandlerFunc {
+	return h
+}
+func (c *routesConsumer) Queues(ctx context.Context) map[string]*consumer.Routes {
+	return c.routes
+}
+
+// cancelRecorder wraps a connection recording the queue of each
+// consumer cancelled, as consumed on the channel it's cancelled on
+type cancelRecorder struct {
+	consumer.Connection
+	mu        *sync.Mutex
+	cancelled []string
+}
+
+func (c *cancelRecorder) Channel() (consumer.Channel, error) {
+	ch, err := c.Connection.Channel()
+	if err != nil {
+		return nil, err
+	}
+	return &cancelRecorderChannel{Channel: ch, c: c, queues: make(map[string]string)}, nil
+}
+
+type cancelRecorderChannel struct {
+	consumer.Channel
+	c *cancelRecorder
+	// queues are the queues consumed on the channel by tag
+	queues map[string]string
+}
+
+func (ch *cancelRecorderChannel) Consume(queue, tag string, autoAck, exclusive, noLocal, noWait bool, args amqp.Table) (<-chan amqp.Delivery, error) {
+	ch.c.mu.Lock()
+	ch.queues[tag] = queue
+	ch.c.mu.Unlock()
+	return ch.Channel.Consume(queue, tag, autoAck, exclusive, noLocal, noWait, args)
+}
+
+func (ch *cancelRecorderChannel) Cancel(tag string, noWait bool) error {
+	ch.c.mu.Lock()
+	ch.c.cancelled = append(ch.c.cancelled, ch.queues[tag])
+	ch.c.mu.Unlock()
+	return ch.Channel.Cancel(tag, noWait)
+}
+
+func TestHostPrefix(t *testing.T) {
+	b := memory.NewBroker()
+	rec := &cancelRecorder{mu: &sync.Mutex{}}
+	sep := "_"
+	h := consumer.NewConsumerHost(&consumer.HostConfig{
+		Address:         "mem",
+		PrefixSeparator: &sep,
+		Dial: func(address string) (consumer.Connection, error) {
+			conn, err := b.Dial(address)
+			if err != nil {
+				return nil, err
+			}
+			rec.Connection = conn
+			return rec, nil
+		},
+	})
+	tags := make(chan string, 1)
+	h.AddBroker(context.Background(), &consumer.ExchangeConfig{Name: "ex"}, []consumer.Consumer{&routesConsumer{
+		prefix: "svc",
+		cfg:    &consumer.ConsumerConfig{Name: "billing"},
+		routes: map[string]*consumer.Routes{
+			"orders": {Keys: []string{"orders.#"}, DeliveryFunc: func(ctx context.Context, d amqp.Delivery) error {
+				tags <- d.ConsumerTag
+				return nil
+			}},
+		},
+	}})
+	if err := h.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { h.Stop(context.Background()) })
+
+	for _, q := range []string{"svc_orders", "svc_billing.deadletter"} {
+		if _, ok := b.Queue(q); !ok {
+			t.Errorf("queue %s wasn't declared", q)
+		}
+	}
+	for _, q := range []string{"orders", "svc.orders", "billing.deadletter", "svc.billing.deadletter"} {
+		if _, ok := b.Queue(q); ok {
+			t.Errorf("queue %s declared without the prefix", q)
+		}
+	}
+
+	publish(t, b, "ex", "orders.created", 1)
+	select {
+	case tag := <-tags:
+		if !strings.HasPrefix(tag, "svc_billing-") {
+			t.Errorf("consumer tag %s, want it prefixed with svc_billing-", tag)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("message not delivered")
+	}
+
+	// Stop cancels each consumer on the channel registered
+	// for its queue, which consumed it with the same tag
+	if err := h.Stop(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	if len(rec.cancelled) != 1 || rec.cancelled[0] != "svc_orders" {
+		t.Fatalf("cancelled consumers of %q, want svc_orders", rec.cancelled)
+	}
+}
+
+func TestHostQueueConfig(t *testing.T) {
+	b := memory.NewBroker()
+	failed := func(ctx context.Context, d amqp.Delivery) error {
+		return errors.New("failed")
+	}
+	startHost(t, b, &routesConsumer{
+		cfg: &consumer.ConsumerConfig{Name: "billing"},
+		routes: map[string]*consumer.Routes{
+			"orders": {Keys: []string{"orders.#"}, DeliveryFunc: failed},
+			// refunds has its own deadletter queue and is retried
+			"refunds": {Keys: []string{"refunds.#"}, DeliveryFunc: failed, Config: &consumer.ConsumerConfig{
+				Name:           "refunds",
+				DeadletterName: strp("refunds.failed"),
+				Retry:          retryPolicy(),
+			}},
+		},
+	})
+
+	for _, q := range []string{"orders", "billing.deadletter", "refunds", "refunds.failed", "refunds.retry.20", "refunds.retry.40"} {
+		if _, ok := b.Queue(q); !ok {
+			t.Errorf("queue %s wasn't declared", q)
+		}
+	}
+	for _, q := range []string{"refunds.deadletter", "orders.retry.20", "billing.retry.20"} {
+		if _, ok := b.Queue(q); ok {
+			t.Errorf("queue %s declared", q)
+		}
+	}
+
+	publish(t, b, "ex", "orders.created", 1)
+	publish(t, b, "ex", "refunds.created", 1)
+	waitFor(t, "dead-letters", func() bool {
+		billing, _ := b.Queue("billing.deadletter")
+		refunds, _ := b.Queue("refunds.failed")
+		return billing.Ready == 1 && refunds.Ready == 1
+	})
+	for _, q := range []string{"orders", "refunds", "refunds.retry.20", "refunds.retry.40"} {
+		if s, _ := b.Queue(q); s.Ready != 0 || s.Unacked != 0 {
+			t.Errorf("queue %s %+v, want it empty", q, s)
+		}
+	}
+}
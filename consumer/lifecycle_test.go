@@ -0,0 +1,141 @@
+package consumer_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/streadway/amqp"
+	"github.com/theflyingcodr/rabbitmq/consumer"
+	"github.com/theflyingcodr/rabbitmq/memory"
+)
+
+func TestRunStopsOnContextCancel(t *testing.T) {
+	b := memory.NewBroker()
+	h := consumer.NewConsumerHost(&consumer.HostConfig{Address: "mem", Dial: b.Dial})
+	handled := make(chan struct{}, 1)
+	h.AddBroker(context.Background(), &consumer.ExchangeConfig{Name: "ex"}, []consumer.Consumer{&testConsumer{
+		cfg:   &consumer.ConsumerConfig{Name: "q"},
+		queue: "q",
+		key:   "q",
+		handler: func(context.Context, amqp.Delivery) error {
+			select {
+			case handled <- struct{}{}:
+			default:
+			}
+			return nil
+		},
+	}})
+	ctx, cancel := context.WithCancel(context.Background())
+	errs := make(chan error, 1)
+	go func() { errs <- h.Run(ctx) }()
+	// a handled message means Start has finished waiting to connect
+	waitFor(t, "message handled", func() bool {
+		publish(t, b, "ex", "q", 1)
+		select {
+		case <-handled:
+			return true
+		default:
+			return false
+		}
+	})
+	cancel()
+
+	select {
+	case err := <-errs:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("run didn't return")
+	}
+	if h.GetConnectionStatus() {
+		t.Fatal("still connected")
+	}
+}
+
+func TestRunStopsWhenCancelledBeforeConnecting(t *testing.T) {
+	b := memory.NewBroker()
+	b.SetDown(true)
+	initial := 10 * time.Millisecond
+	h := consumer.NewConsumerHost(&consumer.HostConfig{
+		Address:   "mem",
+		Dial:      b.Dial,
+		Reconnect: &consumer.ReconnectPolicy{InitialDelay: &initial},
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := h.Run(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("got %v, want deadline exceeded", err)
+	}
+	select {
+	case <-h.Done():
+	default:
+		t.Fatal("done not closed")
+	}
+
+	// the abandoned host doesn't connect once the broker is back
+	b.SetDown(false)
+	time.Sleep(100 * time.Millisecond)
+	if h.GetConnectionStatus() {
+		t.Fatal("connected after Run returned")
+	}
+}
+
+func TestStartDeclaresQueuesBeforeConsuming(t *testing.T) {
+	b := memory.NewBroker()
+	declareQueue(t, b, "orders", amqp.Table{"x-max-length": int32(10)})
+
+	h := consumer.NewConsumerHost(&consumer.HostConfig{Address: "mem", Dial: b.Dial})
+	called := make(chan error, 1)
+	h.OnError(func(err error) { called <- err })
+	h.AddBroker(context.Background(), &consumer.ExchangeConfig{Name: "ex"}, []consumer.Consumer{
+		&testConsumer{cfg: &consumer.ConsumerConfig{Name: "ok"}, queue: "ok", key: "ok", handler: ack},
+		&testConsumer{cfg: &consumer.ConsumerConfig{Name: "orders"}, queue: "orders", key: "orders", handler: ack},
+	})
+
+	err := h.Start(context.Background())
+	var qe *consumer.QueueError
+	if !errors.As(err, &qe) || qe.Queue != "orders" {
+		t.Fatalf("got %v, want a QueueError for orders", err)
+	}
+	var conflict *consumer.DeclareConflictError
+	if !errors.As(err, &conflict) {
+		t.Fatalf("got %v, want a DeclareConflictError", err)
+	}
+	if q, _ := b.Queue("ok"); q.Consumers != 0 {
+		t.Fatal("ok was consumed before every queue was declared")
+	}
+	select {
+	case <-h.Done():
+	default:
+		t.Fatal("done not closed")
+	}
+	select {
+	case err := <-called:
+		t.Fatalf("OnError called with a startup error: %v", err)
+	default:
+	}
+}
+
+func ack(ctx context.Context, d amqp.Delivery) error {
+	return nil
+}
+
+// declareQueue declares a queue as another service would have
+func declareQueue(t *testing.T, b *memory.Broker, name string, args amqp.Table) {
+	t.Helper()
+	conn, err := b.Dial("mem")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	ch, err := conn.Channel()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ch.QueueDeclare(name, true, false, false, false, args); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,393 @@
+package consumer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/streadway/amqp"
+)
+
+// Actions a Plan reports for each exchange, queue & binding
+const (
+	// PlanCreate is reported for entities which don't exist yet
+	PlanCreate = "create"
+	// PlanNoop is reported for entities which exist with
+	// arguments equivalent to those configured
+	PlanNoop = "no-op"
+	// PlanConflict is reported for entities which exist with
+	// different arguments, declaring them would fail with a
+	// PRECONDITION_FAILED channel close
+	PlanConflict = "conflict"
+	// PlanExists is reported for entities which exist when the
+	// planner doesn't Redeclare, their arguments aren't compared
+	PlanExists = "exists"
+	// PlanBind is reported for bindings, these can't be
+	// inspected over amqp but binding is idempotent
+	PlanBind = "bind"
+)
+
+// Kinds of entity in a Plan
+const (
+	KindExchange = "exchange"
+	KindQueue    = "queue"
+	KindBinding  = "binding"
+)
+
+// Change is the action BuildExchange or BuildQueue
+// would take for an exchange, queue or binding
+type Change struct {
+	Action string `json:"action"`
+	Kind   string `json:"kind"`
+	Name   string `json:"name"`
+	// Detail is the broker's reason for a conflict
+	// or the source & key of a binding
+	Detail string `json:"detail,omitempty"`
+}
+
+// Plan lists the changes deploying a topology would make
+type Plan struct {
+	Changes []Change `json:"changes"`
+}
+
+// Conflicts returns the changes which would fail
+func (p *Plan) Conflicts() []Change {
+	var c []Change
+	for _, ch := range p.Changes {
+		if ch.Action == PlanConflict {
+			c = append(c, ch)
+		}
+	}
+	return c
+}
+
+// String formats the plan as a table, one change per line
+func (p *Plan) String() string {
+	var sb strings.Builder
+	w := tabwriter.NewWriter(&sb, 0, 4, 2, ' ', 0)
+	for _, c := range p.Changes {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", c.Action, c.Kind, c.Name, c.Detail)
+	}
+	w.Flush()
+	return sb.String()
+}
+
+// Planner works out what BuildExchange & BuildQueue would change
+// on the broker.
+//
+// Each exchange & queue is declared passively, so planning doesn't
+// change the broker, and ones which exist are reported as PlanExists.
+// amqp doesn't return the arguments of an existing entity so conflicts
+// are only found when Redeclare is set. A failed declare closes the
+// channel so a new one is opened for the next check
+type Planner struct {
+	// Redeclare declares entities the passive declare finds with their
+	// configured arguments, which the broker accepts without change
+	// when they're equivalent and rejects with PRECONDITION_FAILED when
+	// they aren't. The declare isn't passive, an entity deleted between
+	// the two declares is created again and redeclaring a queue renews
+	// its x-expires lease, so only set it when that's acceptable
+	Redeclare bool
+
+	conn Connection
+	cfg  *HostConfig
+	ch   Channel
+	// planned records the action for each entity
+	// already checked, keyed by kind & name
+	planned map[string]string
+}
+
+// NewPlanner sets up a planner for the broker connected
+// to by conn, queues are named as they would be by a Host
+// setup with cfg
+func NewPlanner(conn Connection, cfg *HostConfig) *Planner {
+	if cfg == nil {
+		cfg = &HostConfig{}
+	}
+	return &Planner{
+		conn:    conn,
+		cfg:     cfg,
+		planned: make(map[string]string),
+	}
+}
+
+// Close closes the channel used for planning, the
+// connection is left open
+func (p *Planner) Close() error {
+	if p.ch == nil {
+		return nil
+	}
+	ch := p.ch
+	p.ch = nil
+	return ch.Close()
+}
+
+// PlanTopology plans each exchange & queue in the topology
+func (p *Planner) PlanTopology(ctx context.Context, t *Topology) (*Plan, error) {
+	if err := t.Validate(); err != nil {
+		return nil, err
+	}
+	plan := &Plan{}
+	for i := range t.Brokers {
+		b := &t.Brokers[i]
+		bp, err := p.PlanBroker(ctx, &b.Exchange, []Consumer{b.consumer(nil)})
+		if err != nil {
+			return nil, err
+		}
+		plan.Changes = append(plan.Changes, bp.Changes...)
+	}
+	return plan, nil
+}
+
+// PlanBroker plans the exchange and the queues of its consumers as
+// they'd be setup by AddBroker, including the deadletter exchange,
+// alternate exchange, deadletter queues & retry queues
+func (p *Planner) PlanBroker(ctx context.Context, ex *ExchangeConfig, consumers []Consumer) (*Plan, error) {
+	n, err := ex.GetName()
+	if err != nil {
+		return nil, err
+	}
+	if err := ex.validateType(); err != nil {
+		return nil, err
+	}
+
+	plan := &Plan{}
+	add := func(c Change, err error) error {
+		if err != nil {
+			return err
+		}
+		plan.Changes = append(plan.Changes, c)
+		return nil
+	}
+
+	if ex.AlternateExchange != nil {
+		ae := *ex.AlternateExchange
+		if err := add(p.exchange(ae, FANOUT_EXCHANGE, true, false, false, nil)); err != nil {
+			return nil, err
+		}
+		if err := add(p.queue(ae, true, false, false, nil)); err != nil {
+			return nil, err
+		}
+		plan.Changes = append(plan.Changes, binding(ae, ae, ""))
+	}
+	if err := add(p.exchange(ex.GetDeadletterName(), ex.GetType(), ex.GetDurable(), ex.GetAutoDelete(), ex.GetInternal(), nil)); err != nil {
+		return nil, err
+	}
+	if err := add(p.exchange(n, ex.GetType(), ex.GetDurable(), ex.GetAutoDelete(), ex.GetInternal(), ex.declareArgs())); err != nil {
+		return nil, err
+	}
+	for _, b := range ex.Bindings {
+		c, err := p.source(n, b.Source)
+		if err != nil {
+			return nil, err
+		}
+		if c != nil {
+			plan.Changes = append(plan.Changes, *c)
+			continue
+		}
+		keys := b.Keys
+		if len(keys) == 0 {
+			keys = []string{""}
+		}
+		for _, k := range keys {
+			plan.Changes = append(plan.Changes, binding(n, b.Source, k))
+		}
+	}
+
+	for _, c := range consumers {
+		changes, err := p.consumer(ctx, ex, c)
+		if err != nil {
+			return nil, err
+		}
+		plan.Changes = append(plan.Changes, changes...)
+	}
+	return plan, nil
+}
+
+// consumer plans the queues of a consumer, their bindings,
+// retry queues & deadletter queues
+func (p *Planner) consumer(ctx context.Context, ex *ExchangeConfig, c Consumer) ([]Change, error) {
+	cfg, err := c.Init()
+	if err != nil {
+		return nil, err
+	}
+	if cfg == nil {
+		cfg = &ConsumerConfig{}
+	}
+	cfg.GetName()
+	prefix := c.Prefix()
+
+	queues := c.Queues(ctx)
+	names := make([]string, 0, len(queues))
+	for k := range queues {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	var changes []Change
+	for _, k := range names {
+		r := queues[k]
+		qcfg := cfg.Merge(r.Config)
+		if err := qcfg.Validate(); err != nil {
+			return nil, fmt.Errorf("queue %s: %w", k, err)
+		}
+		bindings, err := r.Bindings(ex.GetType())
+		if err != nil {
+			return nil, fmt.Errorf("queue %s: %w", k, err)
+		}
+
+		key := p.cfg.Prefixed(prefix, k)
+		c, err := p.queue(key, qcfg.GetDurable(), qcfg.GetAutoDelete(), qcfg.GetExclusive(), qcfg.declareArgs(ex))
+		if err != nil {
+			return nil, err
+		}
+		changes = append(changes, c)
+		for _, b := range bindings {
+			changes = append(changes, binding(key, ex.Name, b.Key))
+		}
+		if qcfg.Retry != nil {
+			for _, d := range qcfg.Retry.Delays() {
+				c, err := p.queue(RetryQueueName(key, d), qcfg.GetDurable(), false, false, retryQueueArgs(key, d))
+				if err != nil {
+					return nil, err
+				}
+				changes = append(changes, c)
+			}
+		}
+
+		if !qcfg.GetHasDeadletter() {
+			continue
+		}
+		dlq := p.cfg.Prefixed(prefix, qcfg.GetDeadletterName())
+		c, err = p.queue(dlq, true, false, false, qcfg.deadletterArgs())
+		if err != nil {
+			return nil, err
+		}
+		changes = append(changes, c)
+		for _, b := range bindings {
+			changes = append(changes, binding(dlq, ex.GetDeadletterName(), b.Key))
+		}
+	}
+	return changes, nil
+}
+
+func (p *Planner) exchange(name, kind string, durable, autoDelete, internal bool, args amqp.Table) (Change, error) {
+	return p.check(KindExchange, name, func(ch Channel) error {
+		return ch.ExchangeDeclarePassive(name, kind, durable, autoDelete, internal, false, nil)
+	}, func(ch Channel) error {
+		return ch.ExchangeDeclare(name, kind, durable, autoDelete, internal, false, args)
+	})
+}
+
+func (p *Planner) queue(name string, durable, autoDelete, exclusive bool, args amqp.Table) (Change, error) {
+	return p.check(KindQueue, name, func(ch Channel) error {
+		_, err := ch.QueueDeclarePassive(name, durable, autoDelete, exclusive, false, nil)
+		return err
+	}, func(ch Channel) error {
+		_, err := ch.QueueDeclare(name, durable, autoDelete, exclusive, false, args)
+		return err
+	})
+}
+
+// source checks the source exchange of an exchange binding exists
+// or is planned, returning a conflict if it's missing
+func (p *Planner) source(destination, source string) (*Change, error) {
+	if _, ok := p.planned[KindExchange+"/"+source]; ok {
+		return nil, nil
+	}
+	err := p.do(func(ch Channel) error {
+		return ch.ExchangeDeclarePassive(source, "", false, false, false, false, nil)
+	})
+	detail := ""
+	switch {
+	case err == nil:
+		return nil, nil
+	case isCode(err, amqp.NotFound):
+		detail = fmt.Sprintf("source exchange %s doesn't exist", source)
+	case isAMQPError(err):
+		detail = reason(err)
+	default:
+		return nil, err
+	}
+	return &Change{Action: PlanConflict, Kind: KindBinding, Name: destination, Detail: detail}, nil
+}
+
+// check plans an entity using passive to see if it exists, when
+// redeclaring declare then checks its arguments are equivalent
+func (p *Planner) check(kind, name string, passive, declare func(Channel) error) (Change, error) {
+	c := Change{Kind: kind, Name: name}
+	if a, ok := p.planned[kind+"/"+name]; ok {
+		c.Action = a
+		return c, nil
+	}
+
+	err := p.do(passive)
+	if err == nil && p.Redeclare {
+		err = p.do(declare)
+	}
+	switch {
+	case err == nil && !p.Redeclare:
+		c.Action = PlanExists
+	case err == nil:
+		c.Action = PlanNoop
+	case isCode(err, amqp.NotFound):
+		c.Action = PlanCreate
+	case isAMQPError(err):
+		c.Action = PlanConflict
+		c.Detail = reason(err)
+	default:
+		return c, err
+	}
+	p.planned[kind+"/"+name] = c.Action
+	return c, nil
+}
+
+// do runs fn on the planning channel, opening one if needed, the
+// channel is discarded after an amqp error as the broker closes it
+func (p *Planner) do(fn func(Channel) error) error {
+	if p.ch == nil {
+		ch, err := p.conn.Channel()
+		if err != nil {
+			return err
+		}
+		p.ch = ch
+	}
+	err := fn(p.ch)
+	if isAMQPError(err) {
+		p.Close()
+	}
+	return err
+}
+
+func binding(destination, source, key string) Change {
+	return Change{
+		Action: PlanBind,
+		Kind:   KindBinding,
+		Name:   destination,
+		Detail: fmt.Sprintf("from %s with key '%s'", source, key),
+	}
+}
+
+// isAMQPError reports whether err was returned by the
+// broker, rather than being a client or connection error
+func isAMQPError(err error) bool {
+	var e *amqp.Error
+	return errors.As(err, &e) && e.Server
+}
+
+// reason returns the reason the broker gave for an error
+func reason(err error) string {
+	var e *amqp.Error
+	if errors.As(err, &e) {
+		return e.Reason
+	}
+	return err.Error()
+}
+
+func isCode(err error, code int) bool {
+	var e *amqp.Error
+	return errors.As(err, &e) && e.Code == code
+}
@@ -0,0 +1,118 @@
+package consumer_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/theflyingcodr/rabbitmq/consumer"
+	"github.com/theflyingcodr/rabbitmq/memory"
+)
+
+const planTopology = `
+brokers:
+  - exchange:
+      name: orders
+    queues:
+      orders.created:
+        keys: [orders.created]
+        config:
+          ttl: 5000
+          retry: {max_attempts: 1, backoff: [1s]}
+`
+
+func planned(t *testing.T, b *memory.Broker, redeclare bool) *consumer.Plan {
+	t.Helper()
+	conn, err := b.Dial("mem")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	top, err := consumer.ParseTopology([]byte(planTopology), consumer.TopologyYAML)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := consumer.NewPlanner(conn, nil)
+	p.Redeclare = redeclare
+	defer p.Close()
+	plan, err := p.PlanTopology(context.Background(), top)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return plan
+}
+
+func action(plan *consumer.Plan, kind, name string) string {
+	for _, c := range plan.Changes {
+		if c.Kind == kind && c.Name == name {
+			return c.Action
+		}
+	}
+	return ""
+}
+
+// buildOrders declares the planned topology with a ttl of 1000
+func buildOrders(t *testing.T, b *memory.Broker) {
+	t.Helper()
+	conn, err := b.Dial("mem")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	ch, err := conn.Channel()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ex := &consumer.ExchangeConfig{Name: "orders"}
+	if err := ex.BuildExchange(ch); err != nil {
+		t.Fatal(err)
+	}
+	ttl := uint(1000)
+	cfg := &consumer.ConsumerConfig{Name: "orders.created", Ttl: &ttl, Retry: &consumer.RetryPolicy{MaxAttempts: 1, Backoff: []time.Duration{time.Second}}}
+	if err := cfg.BuildQueue("orders.created", &consumer.Routes{Keys: []string{"orders.created"}}, ch, ex); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPlanMissingTopology(t *testing.T) {
+	b := memory.NewBroker()
+	plan := planned(t, b, false)
+	for _, c := range plan.Changes {
+		if c.Action != consumer.PlanCreate && c.Action != consumer.PlanBind {
+			t.Fatalf("got %+v, want create", c)
+		}
+	}
+
+	// planning didn't create anything
+	if again := planned(t, b, false); action(again, consumer.KindQueue, "orders.created") != consumer.PlanCreate {
+		t.Fatalf("queue created by planning\n%s", again)
+	}
+}
+
+func TestPlanConflict(t *testing.T) {
+	b := memory.NewBroker()
+	buildOrders(t, b)
+	plan := planned(t, b, true)
+	if a := action(plan, consumer.KindExchange, "orders"); a != consumer.PlanNoop {
+		t.Fatalf("exchange %s, want no-op", a)
+	}
+	c := plan.Conflicts()
+	if len(c) != 1 || c[0].Name != "orders.created" {
+		t.Fatalf("got conflicts %+v, want orders.created", c)
+	}
+}
+
+func TestPlanPassiveByDefault(t *testing.T) {
+	b := memory.NewBroker()
+	buildOrders(t, b)
+	plan := planned(t, b, false)
+	if n := len(plan.Conflicts()); n != 0 {
+		t.Fatalf("%d conflicts, passive plans can't find them", n)
+	}
+	if a := action(plan, consumer.KindQueue, "orders.created"); a != consumer.PlanExists {
+		t.Fatalf("queue %s, want exists", a)
+	}
+	if a := action(plan, consumer.KindExchange, "orders.deadletter"); a != consumer.PlanExists {
+		t.Fatalf("deadletter exchange %s, want exists", a)
+	}
+}
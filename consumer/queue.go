@@ -0,0 +1,220 @@
+package consumer
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Overflow behaviours for a queue that has reached its max length
+const (
+	// OverflowDropHead drops or dead-letters the oldest messages
+	OverflowDropHead = "drop-head"
+	// OverflowRejectPublish rejects new messages
+	OverflowRejectPublish = "reject-publish"
+	// OverflowRejectPublishDLX rejects new messages and dead-letters them
+	OverflowRejectPublishDLX = "reject-publish-dlx"
+)
+
+// Queue types set with ConsumerConfig.QueueType
+const (
+	QueueTypeClassic = "classic"
+	QueueTypeQuorum  = "quorum"
+	QueueTypeStream  = "stream"
+)
+
+var (
+	ERRINVALIDQUEUECONFIG = errors.New("invalid queue config")
+)
+
+// typedQueueArgs are the x- arguments set by typed
+// fields along with the name of the field
+var typedQueueArgs = []struct {
+	arg   string
+	field string
+}{
+	{"x-message-ttl", "Ttl"},
+	{"x-max-length", "MaxLength"},
+	{"x-max-length-bytes", "MaxLengthBytes"},
+	{"x-overflow", "Overflow"},
+	{"x-queue-mode", "Lazy"},
+	{"x-single-active-consumer", "SingleActiveConsumer"},
+	{"x-expires", "Expires"},
+	{"x-queue-type", "QueueType"},
+	{"x-delivery-limit", "DeliveryLimit"},
+	{"x-max-age", "MaxAge"},
+}
+
+// Validate checks the queue settings can be declared together, errors
+// wrap ERRINVALIDQUEUECONFIG and name the settings that conflict
+func (c *ConsumerConfig) Validate() error {
+	for _, t := range typedQueueArgs {
+		if _, ok := c.Args[t.arg]; ok && c.typedArgSet(t.arg) {
+			return fmt.Errorf("%w: %s is set by %s and can't also be set in Args", ERRINVALIDQUEUECONFIG, t.arg, t.field)
+		}
+	}
+	if c.Overflow != nil {
+		switch *c.Overflow {
+		case OverflowDropHead, OverflowRejectPublish:
+		case OverflowRejectPublishDLX:
+			if !c.GetHasDeadletter() {
+				return fmt.Errorf("%w: overflow %s needs a deadletter", ERRINVALIDQUEUECONFIG, *c.Overflow)
+			}
+		default:
+			return fmt.Errorf("%w: unknown overflow %q, expected %s, %s or %s", ERRINVALIDQUEUECONFIG,
+				*c.Overflow, OverflowDropHead, OverflowRejectPublish, OverflowRejectPublishDLX)
+		}
+		if c.MaxLength == nil && c.MaxLengthBytes == nil {
+			return fmt.Errorf("%w: overflow %s has no effect without MaxLength or MaxLengthBytes", ERRINVALIDQUEUECONFIG, *c.Overflow)
+		}
+	}
+	if c.Expires != nil && *c.Expires == 0 {
+		return fmt.Errorf("%w: Expires must be greater than 0", ERRINVALIDQUEUECONFIG)
+	}
+	if c.SingleActiveConsumer != nil && *c.SingleActiveConsumer && c.GetExclusive() {
+		return fmt.Errorf("%w: SingleActiveConsumer can't be used with an Exclusive queue", ERRINVALIDQUEUECONFIG)
+	}
+	switch c.GetDeclarePolicy() {
+	case DeclareFail, DeclarePassive, DeclareRecreateIfEmpty:
+	default:
+		return fmt.Errorf("%w: unknown declare policy %q, expected %s, %s or %s", ERRINVALIDQUEUECONFIG,
+			c.GetDeclarePolicy(), DeclareFail, DeclarePassive, DeclareRecreateIfEmpty)
+	}
+	return c.validateQueueType()
+}
+
+// validateQueueType checks the settings are supported by the queue type
+func (c *ConsumerConfig) validateQueueType() error {
+	qt := c.GetQueueType()
+	switch qt {
+	case QueueTypeClassic:
+		if c.DeliveryLimit != nil {
+			return fmt.Errorf("%w: DeliveryLimit is only supported by %s queues", ERRINVALIDQUEUECONFIG, QueueTypeQuorum)
+		}
+		if c.MaxAge != nil {
+			return fmt.Errorf("%w: MaxAge is only supported by %s queues", ERRINVALIDQUEUECONFIG, QueueTypeStream)
+		}
+		return nil
+	case QueueTypeQuorum, QueueTypeStream:
+	default:
+		return fmt.Errorf("%w: unknown queue type %q, expected %s, %s or %s", ERRINVALIDQUEUECONFIG,
+			qt, QueueTypeClassic, QueueTypeQuorum, QueueTypeStream)
+	}
+
+	if !c.GetDurable() {
+		return fmt.Errorf("%w: %s queues must be Durable", ERRINVALIDQUEUECONFIG, qt)
+	}
+	if c.GetExclusive() {
+		return fmt.Errorf("%w: %s queues can't be Exclusive", ERRINVALIDQUEUECONFIG, qt)
+	}
+	if c.GetAutoDelete() {
+		return fmt.Errorf("%w: %s queues can't be AutoDelete", ERRINVALIDQUEUECONFIG, qt)
+	}
+	if c.Lazy != nil && *c.Lazy {
+		return fmt.Errorf("%w: %s queues don't support Lazy", ERRINVALIDQUEUECONFIG, qt)
+	}
+
+	if qt == QueueTypeQuorum {
+		if c.MaxAge != nil {
+			return fmt.Errorf("%w: MaxAge is only supported by %s queues", ERRINVALIDQUEUECONFIG, QueueTypeStream)
+		}
+		if c.Overflow != nil && *c.Overflow == OverflowRejectPublishDLX {
+			return fmt.Errorf("%w: %s queues don't support overflow %s", ERRINVALIDQUEUECONFIG, qt, OverflowRejectPublishDLX)
+		}
+		return nil
+	}
+
+	// streams are append only logs, messages aren't removed when
+	// they are acked so can't expire, be dead-lettered or retried
+	unsupported := []struct {
+		set   bool
+		field string
+	}{
+		{c.Ttl != nil, "Ttl"},
+		{c.MaxLength != nil, "MaxLength"},
+		{c.Overflow != nil, "Overflow"},
+		{c.Expires != nil, "Expires"},
+		{c.SingleActiveConsumer != nil && *c.SingleActiveConsumer, "SingleActiveConsumer"},
+		{c.DeliveryLimit != nil, "DeliveryLimit"},
+		{c.GetHasDeadletter(), "HasDeadletter"},
+		{c.Retry != nil, "Retry"},
+	}
+	for _, u := range unsupported {
+		if u.set {
+			return fmt.Errorf("%w: %s queues don't support %s", ERRINVALIDQUEUECONFIG, qt, u.field)
+		}
+	}
+	if c.GetPrefetchCount() == 0 {
+		return fmt.Errorf("%w: %s queues need a PrefetchCount", ERRINVALIDQUEUECONFIG, qt)
+	}
+	if _, err := ParseStreamOffset(c.GetStreamOffset()); err != nil {
+		return fmt.Errorf("%w: %s", ERRINVALIDQUEUECONFIG, err)
+	}
+	return nil
+}
+
+// typedArgSet returns true if the typed field for the argument is set
+func (c *ConsumerConfig) typedArgSet(arg string) bool {
+	switch arg {
+	case "x-message-ttl":
+		return c.Ttl != nil
+	case "x-max-length":
+		return c.MaxLength != nil
+	case "x-max-length-bytes":
+		return c.MaxLengthBytes != nil
+	case "x-overflow":
+		return c.Overflow != nil
+	case "x-queue-mode":
+		return c.Lazy != nil
+	case "x-single-active-consumer":
+		return c.SingleActiveConsumer != nil
+	case "x-expires":
+		return c.Expires != nil
+	case "x-queue-type":
+		return c.QueueType != nil
+	case "x-delivery-limit":
+		return c.DeliveryLimit != nil
+	case "x-max-age":
+		return c.MaxAge != nil
+	}
+	return false
+}
+
+// QueueArgs returns the arguments the queue is declared with,
+// Args combined with the x- arguments for the typed fields
+func (c *ConsumerConfig) QueueArgs() map[string]interface{} {
+	a := make(map[string]interface{}, len(c.Args))
+	for k, v := range c.Args {
+		a[k] = v
+	}
+	if c.Ttl != nil {
+		a["x-message-ttl"] = int64(*c.Ttl)
+	}
+	if c.MaxLength != nil {
+		a["x-max-length"] = int64(*c.MaxLength)
+	}
+	if c.MaxLengthBytes != nil {
+		a["x-max-length-bytes"] = int64(*c.MaxLengthBytes)
+	}
+	if c.Overflow != nil {
+		a["x-overflow"] = *c.Overflow
+	}
+	if c.Lazy != nil && *c.Lazy {
+		a["x-queue-mode"] = "lazy"
+	}
+	if c.SingleActiveConsumer != nil && *c.SingleActiveConsumer {
+		a["x-single-active-consumer"] = true
+	}
+	if c.Expires != nil {
+		a["x-expires"] = int64(*c.Expires)
+	}
+	if c.QueueType != nil {
+		a["x-queue-type"] = *c.QueueType
+	}
+	if c.DeliveryLimit != nil {
+		a["x-delivery-limit"] = int64(*c.DeliveryLimit)
+	}
+	if c.MaxAge != nil {
+		a["x-max-age"] = *c.MaxAge
+	}
+	return a
+}
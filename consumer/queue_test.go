@@ -0,0 +1,89 @@
+package consumer_test
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/theflyingcodr/rabbitmq/consumer"
+)
+
+func uintp(v uint) *uint    { return &v }
+func strp(v string) *string { return &v }
+func boolp(v bool) *bool    { return &v }
+
+func TestQueueArgs(t *testing.T) {
+	cfg := &consumer.ConsumerConfig{
+		Ttl:                  uintp(1000),
+		MaxLength:            uintp(10),
+		Overflow:             strp(consumer.OverflowRejectPublish),
+		Lazy:                 boolp(true),
+		SingleActiveConsumer: boolp(true),
+		Expires:              uintp(5000),
+		Args:                 map[string]interface{}{"x-max-priority": 5},
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]interface{}{
+		"x-message-ttl":            int64(1000),
+		"x-max-length":             int64(10),
+		"x-overflow":               consumer.OverflowRejectPublish,
+		"x-queue-mode":             "lazy",
+		"x-single-active-consumer": true,
+		"x-expires":                int64(5000),
+		"x-max-priority":           5,
+	}
+	if got := cfg.QueueArgs(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+}
+
+// validConfig is a ConsumerConfig and whether Validate should accept it
+type validConfig struct {
+	cfg   *consumer.ConsumerConfig
+	valid bool
+}
+
+func checkValidate(t *testing.T, tests map[string]validConfig) {
+	t.Helper()
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			err := tt.cfg.Validate()
+			if tt.valid && err != nil {
+				t.Fatal(err)
+			}
+			if !tt.valid && !errors.Is(err, consumer.ERRINVALIDQUEUECONFIG) {
+				t.Fatalf("got %v, want invalid queue config", err)
+			}
+		})
+	}
+}
+
+func TestQueueArgsValidate(t *testing.T) {
+	checkValidate(t, map[string]validConfig{
+		"drop head with max length":   {&consumer.ConsumerConfig{Overflow: strp(consumer.OverflowDropHead), MaxLength: uintp(1)}, true},
+		"unknown overflow":            {&consumer.ConsumerConfig{Overflow: strp("bogus"), MaxLength: uintp(1)}, false},
+		"overflow without max length": {&consumer.ConsumerConfig{Overflow: strp(consumer.OverflowDropHead)}, false},
+		"reject dlx without deadletter": {&consumer.ConsumerConfig{
+			Overflow: strp(consumer.OverflowRejectPublishDLX), MaxLength: uintp(1), HasDeadletter: boolp(false),
+		}, false},
+		"typed arg also in args":           {&consumer.ConsumerConfig{Ttl: uintp(1), Args: map[string]interface{}{"x-message-ttl": 5}}, false},
+		"exclusive single active consumer": {&consumer.ConsumerConfig{SingleActiveConsumer: boolp(true), Exclusive: boolp(true)}, false},
+		"zero expires":                     {&consumer.ConsumerConfig{Expires: uintp(0)}, false},
+	})
+}
+
+func TestQueueTypeValidate(t *testing.T) {
+	stream, quorum := strp(consumer.QueueTypeStream), strp(consumer.QueueTypeQuorum)
+	checkValidate(t, map[string]validConfig{
+		"quorum delivery limit":   {&consumer.ConsumerConfig{QueueType: quorum, DeliveryLimit: uintp(5)}, true},
+		"stream":                  {&consumer.ConsumerConfig{QueueType: stream, PrefetchCount: uintp(10), MaxAge: strp("7D")}, true},
+		"classic delivery limit":  {&consumer.ConsumerConfig{DeliveryLimit: uintp(1)}, false},
+		"unknown queue type":      {&consumer.ConsumerConfig{QueueType: strp("bad")}, false},
+		"transient quorum":        {&consumer.ConsumerConfig{QueueType: quorum, Durable: boolp(false)}, false},
+		"stream without prefetch": {&consumer.ConsumerConfig{QueueType: stream}, false},
+		"stream with retry":       {&consumer.ConsumerConfig{QueueType: stream, PrefetchCount: uintp(10), Retry: &consumer.RetryPolicy{}}, false},
+		"stream bad offset":       {&consumer.ConsumerConfig{QueueType: stream, PrefetchCount: uintp(10), StreamOffset: strp("soon")}, false},
+	})
+}
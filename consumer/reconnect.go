@@ -0,0 +1,153 @@
+package consumer
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"math"
+	"math/rand"
+	"time"
+)
+
+var (
+	ERRRECONNECTEXHAUSTED = errors.New("reconnect policy exhausted")
+	// errShutdown is returned by connect when the host is stopped
+	errShutdown = errors.New("host is shutting down")
+)
+
+// ReconnectPolicy decides how long the host waits between attempts
+// to connect to the broker and when it gives up. Delays grow
+// exponentially from InitialDelay by Multiplier up to MaxDelay, each
+// is then varied by up to Jitter either way so hosts which lost the
+// same broker don't all reconnect together. Delays at MaxDelay are
+// only varied downwards so it's never exceeded.
+//
+// The host gives up once MaxAttempts have failed or MaxElapsed has
+// passed since the connection was lost, whichever is first, and Run
+// returns an error wrapping ERRRECONNECTEXHAUSTED. By default it
+// never gives up
+type ReconnectPolicy struct {
+	InitialDelay *time.Duration `json:"initial_delay"`
+	Multiplier   *float64       `json:"multiplier"`
+	MaxDelay     *time.Duration `json:"max_delay"`
+	// Jitter is the fraction of each delay it can be varied by,
+	// between 0 and 1
+	Jitter *float64 `json:"jitter"`
+	// MaxAttempts is the number of failed attempts allowed
+	// before giving up, 0 means there is no limit
+	MaxAttempts int `json:"max_attempts"`
+	// MaxElapsed is how long to keep trying for, 0 means
+	// there is no limit
+	MaxElapsed time.Duration `json:"max_elapsed"`
+}
+
+// UnmarshalJSON decodes a reconnect policy with its delays
+// written as duration strings such as "500ms" or "1m30s"
+func (r *ReconnectPolicy) UnmarshalJSON(b []byte) error {
+	var raw struct {
+		InitialDelay *duration `json:"initial_delay"`
+		Multiplier   *float64  `json:"multiplier"`
+		MaxDelay     *duration `json:"max_delay"`
+		Jitter       *float64  `json:"jitter"`
+		MaxAttempts  int       `json:"max_attempts"`
+		MaxElapsed   duration  `json:"max_elapsed"`
+	}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&raw); err != nil {
+		return err
+	}
+
+	*r = ReconnectPolicy{
+		Multiplier:  raw.Multiplier,
+		Jitter:      raw.Jitter,
+		MaxAttempts: raw.MaxAttempts,
+		MaxElapsed:  time.Duration(raw.MaxElapsed),
+	}
+	if raw.InitialDelay != nil {
+		d := time.Duration(*raw.InitialDelay)
+		r.InitialDelay = &d
+	}
+	if raw.MaxDelay != nil {
+		d := time.Duration(*raw.MaxDelay)
+		r.MaxDelay = &d
+	}
+	return nil
+}
+
+// GetInitialDelay returns the delay after the first failed
+// attempt, if nil then it returns a default of 200ms
+func (r *ReconnectPolicy) GetInitialDelay() time.Duration {
+	if r.InitialDelay == nil {
+		return 200 * time.Millisecond
+	}
+	return *r.InitialDelay
+}
+
+// GetMultiplier returns the factor each delay is
+// increased by, if nil then it returns a default of 2
+func (r *ReconnectPolicy) GetMultiplier() float64 {
+	if r.Multiplier == nil {
+		return 2
+	}
+	return *r.Multiplier
+}
+
+// GetMaxDelay returns the longest delay between attempts,
+// if nil then it returns a default of 30 seconds
+func (r *ReconnectPolicy) GetMaxDelay() time.Duration {
+	if r.MaxDelay == nil {
+		return 30 * time.Second
+	}
+	return *r.MaxDelay
+}
+
+// GetJitter returns the fraction delays are varied by, if nil
+// then it returns a default of 0.2. It's limited to between 0 and 1
+func (r *ReconnectPolicy) GetJitter() float64 {
+	if r.Jitter == nil {
+		return 0.2
+	}
+	return math.Min(math.Max(*r.Jitter, 0), 1)
+}
+
+// Delay returns how long to wait after the failed attempt
+// before trying again, attempts start at 1
+func (r *ReconnectPolicy) Delay(attempt int) time.Duration {
+	if attempt < 1 {
+		attempt = 1
+	}
+	d := float64(r.GetInitialDelay()) * math.Pow(r.GetMultiplier(), float64(attempt-1))
+	jitter := r.GetJitter() * (2*rand.Float64() - 1)
+	if max := float64(r.GetMaxDelay()); max > 0 && d >= max {
+		// clamped before the jitter so delays at the
+		// cap still vary, only downwards to stay under it
+		d = max
+		jitter = -math.Abs(jitter)
+	}
+	return time.Duration(d + d*jitter)
+}
+
+// exhausted reports whether the host should give up after
+// the attempt, elapsed includes the delay before the next one
+func (r *ReconnectPolicy) exhausted(attempt int, elapsed time.Duration) bool {
+	if r.MaxAttempts > 0 && attempt >= r.MaxAttempts {
+		return true
+	}
+	return r.MaxElapsed > 0 && elapsed > r.MaxElapsed
+}
+
+// ReconnectEvent is sent to listeners registered with
+// NotifyReconnect after each attempt to connect
+type ReconnectEvent struct {
+	Address string
+	// Attempt counts the attempts since the connection was lost
+	Attempt int
+	// Err is why the attempt failed, nil if it connected
+	Err error
+	// Delay is how long until the next attempt, 0 if the
+	// attempt connected or the host has given up
+	Delay time.Duration
+	// Elapsed is the time since the connection was lost
+	Elapsed time.Duration
+}
@@ -0,0 +1,201 @@
+package consumer_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/theflyingcodr/rabbitmq/consumer"
+	"github.com/theflyingcodr/rabbitmq/memory"
+)
+
+func TestReconnectPolicyDelay(t *testing.T) {
+	var p consumer.ReconnectPolicy
+	if err := json.Unmarshal([]byte(`{"initial_delay":"100ms","max_delay":"1s","jitter":0}`), &p); err != nil {
+		t.Fatal(err)
+	}
+	want := []time.Duration{100, 200, 400, 800, 1000, 1000}
+	for i, w := range want {
+		if d := p.Delay(i + 1); d != w*time.Millisecond {
+			t.Fatalf("attempt %d delay %s, want %s", i+1, d, w*time.Millisecond)
+		}
+	}
+
+	jitter := 0.5
+	p.Jitter = &jitter
+	for i := 0; i < 100; i++ {
+		if d := p.Delay(2); d < 100*time.Millisecond || d > 300*time.Millisecond {
+			t.Fatalf("delay %s outside jitter", d)
+		}
+	}
+
+	// delays at the cap vary but don't exceed it
+	seen := make(map[time.Duration]bool)
+	for i := 0; i < 100; i++ {
+		d := p.Delay(10)
+		if d < 500*time.Millisecond || d > time.Second {
+			t.Fatalf("delay %s outside jitter under the cap", d)
+		}
+		seen[d] = true
+	}
+	if len(seen) < 2 {
+		t.Fatalf("delays at the cap are all %s", p.Delay(10))
+	}
+}
+
+func TestReconnectExhausted(t *testing.T) {
+	b := memory.NewBroker()
+	b.SetDown(true)
+	initial := 10 * time.Millisecond
+	h := consumer.NewConsumerHost(&consumer.HostConfig{
+		Address:   "mem",
+		Dial:      b.Dial,
+		Reconnect: &consumer.ReconnectPolicy{InitialDelay: &initial, MaxAttempts: 3},
+	})
+	err := h.Start(context.Background())
+	if !errors.Is(err, consumer.ERRRECONNECTEXHAUSTED) {
+		t.Fatalf("got %v, want reconnect exhausted", err)
+	}
+	select {
+	case <-h.Done():
+	case <-time.After(time.Second):
+		t.Fatal("done not closed")
+	}
+}
+
+func TestStopInterruptsReconnect(t *testing.T) {
+	b := memory.NewBroker()
+	var dials atomic.Int64
+	initial := 10 * time.Millisecond
+	h := consumer.NewConsumerHost(&consumer.HostConfig{
+		Address: "mem",
+		Dial: func(address string) (consumer.Connection, error) {
+			dials.Add(1)
+			return b.Dial(address)
+		},
+		Reconnect: &consumer.ReconnectPolicy{InitialDelay: &initial},
+	})
+	waitFor(t, "connection", h.GetConnectionStatus)
+
+	b.SetDown(true)
+	waitFor(t, "reconnect attempts", func() bool { return dials.Load() > 2 })
+	if err := h.Stop(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	n := dials.Load()
+	b.SetDown(false)
+	time.Sleep(100 * time.Millisecond)
+	if d := dials.Load(); d > n+1 {
+		t.Fatalf("dialed %d more times after Stop", d-n)
+	}
+	if h.GetConnectionStatus() {
+		t.Fatal("connected after Stop")
+	}
+}
+
+// cluster dials a memory broker for each address
+// unless it's been marked as down
+type cluster struct {
+	b      *memory.Broker
+	mu     sync.Mutex
+	down   map[string]bool
+	dialed []string
+}
+
+func (c *cluster) dial(address string) (consumer.Connection, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.dialed = append(c.dialed, address)
+	if c.down[address] {
+		return nil, errors.New("connection refused")
+	}
+	return c.b.Dial(address)
+}
+
+func (c *cluster) up(address string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.down[address] = false
+}
+
+// fail marks address as down and returns the addresses dialed since the last call
+func (c *cluster) fail(address string) []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.down[address] = true
+	dialed := c.dialed
+	c.dialed = nil
+	return dialed
+}
+
+// connected returns the address of the next successful connection
+func connected(t *testing.T, events chan consumer.ReconnectEvent) string {
+	t.Helper()
+	for {
+		select {
+		case e := <-events:
+			if e.Err == nil {
+				return e.Address
+			}
+		case <-time.After(time.Second):
+			t.Fatal("didn't connect")
+		}
+	}
+}
+
+func TestFailoverBetweenAddresses(t *testing.T) {
+	c := &cluster{b: memory.NewBroker(), down: map[string]bool{
+		"amqp://u:secret@a": true,
+		"amqp://u:secret@b": true,
+		"amqp://u:secret@c": true,
+	}}
+	initial, maxDelay := 10*time.Millisecond, 20*time.Millisecond
+	cfg := &consumer.HostConfig{
+		Address:   "amqp://u:secret@a",
+		Addresses: []string{"amqp://u:secret@b", "amqp://u:secret@a", "", "amqp://u:secret@c"},
+		Dial:      c.dial,
+		Reconnect: &consumer.ReconnectPolicy{InitialDelay: &initial, MaxDelay: &maxDelay, MaxAttempts: 12},
+	}
+	if got := cfg.GetAddresses(); len(got) != 3 {
+		t.Fatalf("addresses %v, want a, b & c", got)
+	}
+	h := consumer.NewConsumerHost(cfg)
+	events := h.NotifyReconnect(make(chan consumer.ReconnectEvent, 100))
+	c.up("amqp://u:secret@b")
+	if address := connected(t, events); address != "amqp://u:secret@b" {
+		t.Fatalf("connected to %s, want b", address)
+	}
+	if err := h.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	c.up("amqp://u:secret@c")
+	c.fail("amqp://u:secret@b")
+
+	// addresses are tried round robin from the one which was lost
+	c.b.Disconnect()
+	if address := connected(t, events); address != "amqp://u:secret@c" {
+		t.Fatalf("reconnected to %s, want c", address)
+	}
+	if dialed := c.fail("amqp://u:secret@c"); dialed[0] != "amqp://u:secret@c" {
+		t.Fatalf("dialed %v, want c first", dialed)
+	}
+
+	c.b.Disconnect()
+	select {
+	case <-h.Done():
+	case <-time.After(time.Second):
+		t.Fatal("host didn't give up reconnecting")
+	}
+	err := h.Err()
+	if !errors.Is(err, consumer.ERRRECONNECTEXHAUSTED) {
+		t.Fatalf("got %v, want reconnect exhausted", err)
+	}
+	if strings.Contains(err.Error(), "secret") {
+		t.Fatalf("%v contains the password", err)
+	}
+}
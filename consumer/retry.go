@@ -0,0 +1,510 @@
+package consumer
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/streadway/amqp"
+)
+
+var (
+	// ERRNOTCONFIRMED is returned when the broker nacks a retry
+	ERRNOTCONFIRMED = errors.New("retry was not confirmed")
+	// ERRUNROUTABLE is returned when a retry isn't routed to its queue
+	ERRUNROUTABLE = errors.New("retry queue not found")
+)
+
+const (
+	// RetryAttemptHeader holds the number of times
+	// a message has been sent to a retry queue
+	RetryAttemptHeader = "x-retry-attempt"
+	// OriginalExchangeHeader & OriginalRoutingKeyHeader hold where a
+	// message was first published, retry queues route messages back
+	// through the default exchange which replaces both
+	OriginalExchangeHeader   = "x-original-exchange"
+	OriginalRoutingKeyHeader = "x-original-routing-key"
+)
+
+// RetryPolicy defines how many times a message which failed to
+// be handled is retried and how long to wait before each attempt.
+//
+// Each distinct delay has its own retry queue, named
+// %QueueName%.retry.%DelayMs%, with a message TTL of the delay. When
+// a message expires it is dead-lettered straight back to the original
+// queue. Once the final attempt fails the message is dead-lettered
+//
+// Delays are taken from Backoff if set, otherwise they grow
+// exponentially from InitialDelay by Multiplier up to MaxDelay
+type RetryPolicy struct {
+	// MaxAttempts is the number of times a message is
+	// retried after its first delivery fails
+	MaxAttempts int `json:"max_attempts"`
+	// Backoff lists the delay before each attempt, the last
+	// delay is used for any further attempts
+	Backoff      []time.Duration `json:"backoff"`
+	InitialDelay *time.Duration  `json:"initial_delay"`
+	Multiplier   *float64        `json:"multiplier"`
+	MaxDelay     *time.Duration  `json:"max_delay"`
+}
+
+// UnmarshalJSON decodes a retry policy with its delays written as
+// duration strings such as "500ms" or "1m30s", as they are in
+// topology files. Numbers are read as nanoseconds
+func (r *RetryPolicy) UnmarshalJSON(b []byte) error {
+	var raw struct {
+		MaxAttempts  int        `json:"max_attempts"`
+		Backoff      []duration `json:"backoff"`
+		InitialDelay *duration  `json:"initial_delay"`
+		Multiplier   *float64   `json:"multiplier"`
+		MaxDelay     *duration  `json:"max_delay"`
+	}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&raw); err != nil {
+		return err
+	}
+
+	*r = RetryPolicy{MaxAttempts: raw.MaxAttempts, Multiplier: raw.Multiplier}
+	for _, d := range raw.Backoff {
+		r.Backoff = append(r.Backoff, time.Duration(d))
+	}
+	if raw.InitialDelay != nil {
+		d := time.Duration(*raw.InitialDelay)
+		r.InitialDelay = &d
+	}
+	if raw.MaxDelay != nil {
+		d := time.Duration(*raw.MaxDelay)
+		r.MaxDelay = &d
+	}
+	return nil
+}
+
+// duration decodes a time.Duration from a duration string
+type duration time.Duration
+
+func (d *duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		var n int64
+		if err := json.Unmarshal(b, &n); err != nil {
+			return fmt.Errorf("invalid duration %s, expected a string such as \"5s\"", b)
+		}
+		*d = duration(n)
+		return nil
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = duration(v)
+	return nil
+}
+
+// GetInitialDelay returns the delay before the first
+// retry, if nil then it returns a default of 1 second
+func (r *RetryPolicy) GetInitialDelay() time.Duration {
+	if r.InitialDelay == nil {
+		return time.Second
+	}
+	return *r.InitialDelay
+}
+
+// GetMultiplier returns the factor each delay is
+// increased by, if nil then it returns a default of 2
+func (r *RetryPolicy) GetMultiplier() float64 {
+	if r.Multiplier == nil {
+		return 2
+	}
+	return *r.Multiplier
+}
+
+// GetMaxDelay returns the longest delay between attempts,
+// if nil then it returns 0 meaning there is no limit
+func (r *RetryPolicy) GetMaxDelay() time.Duration {
+	if r.MaxDelay == nil {
+		return 0
+	}
+	return *r.MaxDelay
+}
+
+// Delay returns how long to wait before the attempt, attempts
+// start at 1. Delays are rounded to the millisecond as that is
+// the precision of queue TTLs
+func (r *RetryPolicy) Delay(attempt int) time.Duration {
+	if attempt < 1 {
+		attempt = 1
+	}
+	if len(r.Backoff) > 0 {
+		if attempt > len(r.Backoff) {
+			return r.Backoff[len(r.Backoff)-1].Round(time.Millisecond)
+		}
+		return r.Backoff[attempt-1].Round(time.Millisecond)
+	}
+
+	d := time.Duration(float64(r.GetInitialDelay()) * math.Pow(r.GetMultiplier(), float64(attempt-1)))
+	if max := r.GetMaxDelay(); max > 0 && (d > max || d < 0) {
+		d = max
+	}
+	return d.Round(time.Millisecond)
+}
+
+// Delays returns each distinct delay used by the
+// policy, a retry queue is needed for each
+func (r *RetryPolicy) Delays() []time.Duration {
+	delays := make([]time.Duration, 0)
+	seen := make(map[time.Duration]bool)
+	for a := 1; a <= r.MaxAttempts; a++ {
+		d := r.Delay(a)
+		if !seen[d] {
+			seen[d] = true
+			delays = append(delays, d)
+		}
+	}
+	return delays
+}
+
+// RetryQueueName returns the name of the retry
+// queue holding messages for the delay provided
+func RetryQueueName(queueName string, delay time.Duration) string {
+	return fmt.Sprintf("%s.retry.%d", queueName, delay/time.Millisecond)
+}
+
+// retryQueueArgs returns the arguments for a retry queue, messages
+// expire after the delay and are dead-lettered back to the queue
+func retryQueueArgs(queueName string, delay time.Duration) amqp.Table {
+	return amqp.Table{
+		"x-message-ttl":             int64(delay / time.Millisecond),
+		"x-dead-letter-exchange":    "",
+		"x-dead-letter-routing-key": queueName,
+	}
+}
+
+// RetryChannel is used by a Retrier to declare retry
+// queues and publish failed messages to them
+type RetryChannel interface {
+	QueueDeclare(name string, durable, autoDelete, exclusive, noWait bool, args amqp.Table) (amqp.Queue, error)
+	Publish(exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error
+}
+
+// confirmedChannel is a RetryChannel which waits for the broker to
+// confirm each message, mandatory messages that weren't routed to a
+// queue are returned and reported as failing to publish
+type confirmedChannel struct {
+	ch       Channel
+	mu       *sync.Mutex
+	confirms chan amqp.Confirmation
+	returns  chan amqp.Return
+}
+
+// newConfirmedChannel puts ch into confirm mode to publish retries on
+func newConfirmedChannel(ch Channel) (*confirmedChannel, error) {
+	if err := ch.Confirm(false); err != nil {
+		return nil, err
+	}
+	return &confirmedChannel{
+		ch: ch,
+		mu: &sync.Mutex{},
+		// one message is published at a time so
+		// a single confirm is outstanding at most
+		confirms: ch.NotifyPublish(make(chan amqp.Confirmation, 1)),
+		returns:  ch.NotifyReturn(make(chan amqp.Return, 1)),
+	}, nil
+}
+
+func (c *confirmedChannel) QueueDeclare(name string, durable, autoDelete, exclusive, noWait bool, args amqp.Table) (amqp.Queue, error) {
+	return c.ch.QueueDeclare(name, durable, autoDelete, exclusive, noWait, args)
+}
+
+// Publish publishes msg and waits for its confirm, an error is
+// returned if it's nacked, returned or the channel is closed first
+func (c *confirmedChannel) Publish(exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err := c.ch.Publish(exchange, key, mandatory, immediate, msg); err != nil {
+		return err
+	}
+	returned := false
+	for {
+		select {
+		case r, ok := <-c.returns:
+			if !ok {
+				return amqp.ErrClosed
+			}
+			log.Debugf("message with key %s returned: %s", r.RoutingKey, r.ReplyText)
+			returned = true
+		case confirm, ok := <-c.confirms:
+			// the return is sent before the message is
+			// acked so it's already buffered if there is one
+			select {
+			case _, ok := <-c.returns:
+				returned = returned || ok
+			default:
+			}
+			switch {
+			case !ok:
+				return amqp.ErrClosed
+			case !confirm.Ack:
+				return fmt.Errorf("%w: exchange %q key %s", ERRNOTCONFIRMED, exchange, key)
+			case returned:
+				return fmt.Errorf("%w: exchange %q key %s", ERRUNROUTABLE, exchange, key)
+			}
+			return nil
+		}
+	}
+}
+
+// declareRetryQueue declares the retry queue for the delay
+func declareRetryQueue(ch RetryChannel, queueName string, delay time.Duration, cfg *ConsumerConfig) error {
+	rq := RetryQueueName(queueName, delay)
+	log.Debugf("setting up retry queue %s", rq)
+	if _, err := ch.QueueDeclare(rq, cfg.GetDurable(), false, false, cfg.GetNoWait(), retryQueueArgs(queueName, delay)); err != nil {
+		log.Errorf("error setting up retry queue %s: %s", rq, err)
+		return err
+	}
+	return nil
+}
+
+// Retrier sends deliveries which failed to be handled to the retry
+// queue for their next attempt, once the attempts are used up they
+// are dead-lettered with their original routing key
+type Retrier struct {
+	queue      string
+	deadletter string
+	cfg        *ConsumerConfig
+	ch         RetryChannel
+	mu         *sync.Mutex
+	declared   map[time.Duration]bool
+}
+
+// NewRetrier sets up a retrier for the queue using the retry policy
+// in cfg, deadletterExchange is the exchange messages are sent to after
+// their final attempt and should be empty if the queue has no deadletter
+func NewRetrier(queueName, deadletterExchange string, cfg *ConsumerConfig, ch RetryChannel) *Retrier {
+	r := &Retrier{
+		queue:      queueName,
+		deadletter: deadletterExchange,
+		cfg:        cfg,
+		ch:         ch,
+		mu:         &sync.Mutex{},
+		declared:   make(map[time.Duration]bool),
+	}
+	if cfg.Retry != nil {
+		// these are declared by BuildQueue
+		for _, d := range cfg.Retry.Delays() {
+			r.declared[d] = true
+		}
+	}
+	return r
+}
+
+// Attempt returns the number of times the
+// delivery has been sent to a retry queue
+func Attempt(d amqp.Delivery) int {
+	switch a := d.Headers[RetryAttemptHeader].(type) {
+	case int64:
+		return int(a)
+	case int32:
+		return int(a)
+	case int:
+		return a
+	}
+	return 0
+}
+
+// fail settles a delivery that the handler returned an error
+// for, it is retried if the retry policy allows otherwise it is
+// dead-lettered
+func (r *Retrier) fail(d amqp.Delivery) {
+	if r == nil || r.cfg.Retry == nil {
+		d.Nack(false, false)
+		return
+	}
+
+	attempt := Attempt(d) + 1
+	if attempt > r.cfg.Retry.MaxAttempts {
+		r.deadLetter(d)
+		return
+	}
+	r.retry(d, attempt, r.cfg.Retry.Delay(attempt))
+}
+
+// retryAfter retries a delivery after the delay provided, if the
+// consumer has a retry policy its attempts still apply
+func (r *Retrier) retryAfter(d amqp.Delivery, delay time.Duration) {
+	if r == nil {
+		d.Nack(false, false)
+		return
+	}
+
+	attempt := Attempt(d) + 1
+	if r.cfg.Retry != nil && attempt > r.cfg.Retry.MaxAttempts {
+		r.deadLetter(d)
+		return
+	}
+
+	delay = r.retryAfterDelay(delay)
+	r.mu.Lock()
+	if !r.declared[delay] {
+		if err := declareRetryQueue(r.ch, r.queue, delay, r.cfg); err != nil {
+			r.mu.Unlock()
+			d.Nack(false, false)
+			return
+		}
+		r.declared[delay] = true
+	}
+	r.mu.Unlock()
+	r.retry(d, attempt, delay)
+}
+
+// retryAfterDelays are the delays RetryAfter uses when the consumer
+// has no retry policy, so a handler computing its own delays creates
+// at most one retry queue for each
+var retryAfterDelays = []time.Duration{
+	time.Second, 5 * time.Second, 10 * time.Second, 30 * time.Second,
+	time.Minute, 5 * time.Minute, 15 * time.Minute, 30 * time.Minute, time.Hour,
+}
+
+// retryAfterDelay returns the delay of the retry queue to use for
+// a RetryAfter delay, the shortest of the retry policy's delays, or
+// retryAfterDelays if there isn't one, which is at least as long.
+// Negative delays are treated as 0 and delays longer than all of
+// them use the longest
+func (r *Retrier) retryAfterDelay(delay time.Duration) time.Duration {
+	delays := retryAfterDelays
+	if r.cfg.Retry != nil && len(r.cfg.Retry.Delays()) > 0 {
+		delays = r.cfg.Retry.Delays()
+		sort.Slice(delays, func(i, j int) bool { return delays[i] < delays[j] })
+	}
+	if delay < 0 {
+		delay = 0
+	}
+	for _, d := range delays {
+		if d >= delay {
+			return d
+		}
+	}
+	return delays[len(delays)-1]
+}
+
+// retry publishes a delivery to the retry queue for the delay
+func (r *Retrier) retry(d amqp.Delivery, attempt int, delay time.Duration) {
+	q := RetryQueueName(r.queue, delay)
+	msg := publishing(d)
+	msg.Headers[RetryAttemptHeader] = int64(attempt)
+	if err := r.ch.Publish("", q, true, false, msg); err != nil {
+		log.Errorf("error sending message to retry queue %s, requeueing: %s", q, err)
+		d.Nack(false, true)
+		return
+	}
+
+	log.Debugf("message with key %s sent to retry queue %s, attempt %d", d.RoutingKey, q, attempt)
+	d.Ack(false)
+}
+
+// deadLetter dead-letters a delivery after its final attempt. A message
+// that has been through a retry queue has the queue's name as its routing
+// key so it is published to the deadletter exchange with its original key,
+// the death is recorded in x-death as RabbitMq would have
+func (r *Retrier) deadLetter(d amqp.Delivery) {
+	if r == nil {
+		d.Nack(false, false)
+		return
+	}
+	if _, ok := d.Headers[OriginalRoutingKeyHeader]; !ok || r.deadletter == "" {
+		d.Nack(false, false)
+		return
+	}
+
+	msg := publishing(d)
+	msg.Headers = recordDeath(msg.Headers, r.queue, msg.Headers[OriginalExchangeHeader], msg.Headers[OriginalRoutingKeyHeader])
+	if err := r.ch.Publish(r.deadletter, d.RoutingKey, false, false, msg); err != nil {
+		log.Errorf("error deadlettering message with key %s: %s", d.RoutingKey, err)
+		d.Nack(false, true)
+		return
+	}
+	d.Ack(false)
+}
+
+// recordDeath adds a rejected death from the queue to the x-death
+// header, the most recent death is first and a repeated death from
+// the same queue increments its count
+func recordDeath(headers amqp.Table, queueName string, exchange, key interface{}) amqp.Table {
+	deaths, _ := headers["x-death"].([]interface{})
+	updated := make([]interface{}, 0, len(deaths)+1)
+	death := amqp.Table{
+		"count":        int64(0),
+		"reason":       "rejected",
+		"queue":        queueName,
+		"exchange":     exchange,
+		"routing-keys": []interface{}{key},
+	}
+	found := false
+	for _, d := range deaths {
+		t, ok := d.(amqp.Table)
+		if ok && !found && t["queue"] == queueName && t["reason"] == "rejected" {
+			for k, v := range t {
+				death[k] = v
+			}
+			found = true
+			continue
+		}
+		updated = append(updated, d)
+	}
+	count, _ := death["count"].(int64)
+	death["count"] = count + 1
+	death["time"] = time.Now().Truncate(time.Second)
+	headers["x-death"] = append([]interface{}{death}, updated...)
+	return headers
+}
+
+// restoreRouting sets the routing key & exchange of a delivery
+// that has come back from a retry queue to their original values
+func restoreRouting(h HandlerFunc) HandlerFunc {
+	return func(ctx context.Context, d amqp.Delivery) {
+		if key, ok := d.Headers[OriginalRoutingKeyHeader].(string); ok {
+			d.RoutingKey = key
+		}
+		if ex, ok := d.Headers[OriginalExchangeHeader].(string); ok {
+			d.Exchange = ex
+		}
+		h(ctx, d)
+	}
+}
+
+// publishing copies a delivery into a publishing, recording
+// where it was originally published if not already set
+func publishing(d amqp.Delivery) amqp.Publishing {
+	headers := amqp.Table{}
+	for k, v := range d.Headers {
+		headers[k] = v
+	}
+	if _, ok := headers[OriginalRoutingKeyHeader]; !ok {
+		headers[OriginalRoutingKeyHeader] = d.RoutingKey
+		headers[OriginalExchangeHeader] = d.Exchange
+	}
+
+	return amqp.Publishing{
+		Headers:         headers,
+		ContentType:     d.ContentType,
+		ContentEncoding: d.ContentEncoding,
+		DeliveryMode:    d.DeliveryMode,
+		Priority:        d.Priority,
+		CorrelationId:   d.CorrelationId,
+		ReplyTo:         d.ReplyTo,
+		MessageId:       d.MessageId,
+		Timestamp:       d.Timestamp,
+		Type:            d.Type,
+		UserId:          d.UserId,
+		AppId:           d.AppId,
+		Body:            d.Body,
+	}
+}
@@ -0,0 +1,183 @@
+package consumer_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/streadway/amqp"
+	"github.com/theflyingcodr/rabbitmq/consumer"
+	"github.com/theflyingcodr/rabbitmq/consumer/consumertest"
+	"github.com/theflyingcodr/rabbitmq/memory"
+)
+
+func retryPolicy() *consumer.RetryPolicy {
+	return &consumer.RetryPolicy{MaxAttempts: 2, Backoff: []time.Duration{20 * time.Millisecond, 40 * time.Millisecond}}
+}
+
+func TestRetryThenDeadLetter(t *testing.T) {
+	b := memory.NewBroker()
+	got := make(chan amqp.Delivery, 10)
+	startHost(t, b, &testConsumer{
+		cfg:   &consumer.ConsumerConfig{Name: "rc", Retry: retryPolicy()},
+		queue: "rq",
+		key:   "r.#",
+		handler: func(ctx context.Context, d amqp.Delivery) error {
+			got <- d
+			return errors.New("failed")
+		},
+	})
+	publish(t, b, "ex", "r.x", 1)
+
+	for attempt := 0; attempt < 3; attempt++ {
+		select {
+		case d := <-got:
+			if consumer.Attempt(d) != attempt || d.RoutingKey != "r.x" {
+				t.Fatalf("delivery attempt %d key %s, want attempt %d key r.x", consumer.Attempt(d), d.RoutingKey, attempt)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("attempt %d not delivered", attempt)
+		}
+	}
+	waitFor(t, "dead-letter", func() bool {
+		q, _ := b.Queue("rc.deadletter")
+		return q.Ready == 1
+	})
+	for _, name := range []string{"rq.retry.20", "rq.retry.40"} {
+		if _, ok := b.Queue(name); !ok {
+			t.Fatalf("retry queue %s not declared", name)
+		}
+	}
+}
+
+func TestRetryAfterNegativeDelay(t *testing.T) {
+	b := memory.NewBroker()
+	got := make(chan amqp.Delivery, 10)
+	startHost(t, b, &testConsumer{
+		cfg:   &consumer.ConsumerConfig{Name: "rc", Retry: retryPolicy()},
+		queue: "rq",
+		key:   "r.#",
+		handler: func(ctx context.Context, d amqp.Delivery) error {
+			got <- d
+			if consumer.Attempt(d) == 0 {
+				return consumer.RetryAfter(-time.Second, errors.New("failed"))
+			}
+			return nil
+		},
+	})
+	publish(t, b, "ex", "r.x", 1)
+
+	for attempt := 0; attempt < 2; attempt++ {
+		select {
+		case <-got:
+		case <-time.After(time.Second):
+			t.Fatalf("attempt %d not delivered", attempt)
+		}
+	}
+	waitFor(t, "ack", func() bool {
+		q, _ := b.Queue("rq")
+		return q.Ready == 0 && q.Unacked == 0
+	})
+	if _, ok := b.Queue("rq.retry.-1000"); ok {
+		t.Fatal("retry queue declared with a negative ttl")
+	}
+}
+
+type retryAfterConsumer struct {
+	cfg   *consumer.ConsumerConfig
+	delay time.Duration
+}
+
+func (c *retryAfterConsumer) Init() (*consumer.ConsumerConfig, error) { return c.cfg, nil }
+func (c *retryAfterConsumer) Prefix() string                          { return "" }
+func (c *retryAfterConsumer) Middleware(h consumer.HandlerFunc) consumer.HandlerFunc {
+	return h
+}
+func (c *retryAfterConsumer) Queues(ctx context.Context) map[string]*consumer.Routes {
+	return map[string]*consumer.Routes{
+		"q": {Keys: []string{"#"}, DeliveryFunc: func(ctx context.Context, d amqp.Delivery) error {
+			return consumer.RetryAfter(c.delay, errors.New("failed"))
+		}},
+	}
+}
+
+func TestRetryAfterUsesBoundedDelays(t *testing.T) {
+	tests := []struct {
+		policy *consumer.RetryPolicy
+		delay  time.Duration
+		want   string
+	}{
+		{nil, -time.Second, "q.retry.1000"},
+		{nil, 0, "q.retry.1000"},
+		{nil, 3 * time.Second, "q.retry.5000"},
+		{nil, 1234 * time.Millisecond, "q.retry.5000"},
+		{nil, 2 * time.Hour, "q.retry.3600000"},
+		{retryPolicy(), 30 * time.Millisecond, "q.retry.40"},
+		{retryPolicy(), time.Minute, "q.retry.40"},
+		{retryPolicy(), -time.Second, "q.retry.20"},
+	}
+	for _, tt := range tests {
+		h, err := consumertest.New(context.Background(), &retryAfterConsumer{
+			cfg:   &consumer.ConsumerConfig{Name: "c", Retry: tt.policy},
+			delay: tt.delay,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		r := h.Deliver(context.Background(), "k", amqp.Delivery{})
+		if r[0].Outcome != consumertest.Retried || r[0].RetryQueue != tt.want {
+			t.Errorf("RetryAfter(%s) with policy %v got %s to %s, want %s", tt.delay, tt.policy != nil, r[0].Outcome, r[0].RetryQueue, tt.want)
+		}
+	}
+}
+
+func TestRetryRequeuedWhenRetryQueueMissing(t *testing.T) {
+	b := memory.NewBroker()
+	conn, err := b.Dial("mem")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	got := make(chan amqp.Delivery, 10)
+	startHost(t, b, &testConsumer{
+		cfg:   &consumer.ConsumerConfig{Name: "rc", Retry: retryPolicy()},
+		queue: "rq",
+		key:   "r.#",
+		handler: func(ctx context.Context, d amqp.Delivery) error {
+			got <- d
+			if d.Redelivered {
+				return nil
+			}
+			// the retry is returned so the delivery should be requeued
+			ch, err := conn.Channel()
+			if err != nil {
+				return err
+			}
+			defer ch.Close()
+			if _, err := ch.QueueDelete("rq.retry.20", false, false, false); err != nil {
+				return err
+			}
+			return errors.New("failed")
+		},
+	})
+	publish(t, b, "ex", "r.x", 1)
+
+	for _, redelivered := range []bool{false, true} {
+		select {
+		case d := <-got:
+			if d.Redelivered != redelivered || consumer.Attempt(d) != 0 {
+				t.Fatalf("delivery redelivered %t attempt %d, want redelivered %t attempt 0", d.Redelivered, consumer.Attempt(d), redelivered)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("delivery redelivered %t not received", redelivered)
+		}
+	}
+	waitFor(t, "ack", func() bool {
+		q, _ := b.Queue("rq")
+		return q.Ready == 0 && q.Unacked == 0
+	})
+	if q, _ := b.Queue("rc.deadletter"); q.Ready != 0 {
+		t.Fatalf("%d messages dead-lettered, want 0", q.Ready)
+	}
+}
@@ -0,0 +1,272 @@
+package consumer
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/streadway/amqp"
+)
+
+// Stream offsets that can be set as ConsumerConfig.StreamOffset,
+// a numeric offset or RFC3339 timestamp can also be used
+const (
+	// OffsetFirst reads from the first message in the stream
+	OffsetFirst = "first"
+	// OffsetLast reads from the last chunk written to the stream
+	OffsetLast = "last"
+	// OffsetNext reads messages published after the consumer starts
+	OffsetNext = "next"
+)
+
+// StreamOffsetHeader is the header RabbitMq sets on messages
+// delivered from a stream with the message's offset
+const StreamOffsetHeader = "x-stream-offset"
+
+// ParseStreamOffset converts an offset into the value passed
+// as the x-stream-offset consume argument. The offset can be
+// first, last, next, a number or an RFC3339 timestamp
+func ParseStreamOffset(offset string) (interface{}, error) {
+	switch offset {
+	case OffsetFirst, OffsetLast, OffsetNext:
+		return offset, nil
+	}
+	if n, err := strconv.ParseInt(offset, 10, 64); err == nil {
+		if n < 0 {
+			return nil, fmt.Errorf("stream offset %d can't be negative", n)
+		}
+		return n, nil
+	}
+	if t, err := time.Parse(time.RFC3339, offset); err == nil {
+		return t, nil
+	}
+	return nil, fmt.Errorf("invalid stream offset %q, expected %s, %s, %s, a number or an RFC3339 timestamp",
+		offset, OffsetFirst, OffsetLast, OffsetNext)
+}
+
+// GetStreamOffset returns where a stream consumer starts
+// reading from, if nil then it returns a default of OffsetNext
+func (c *ConsumerConfig) GetStreamOffset() string {
+	if c.StreamOffset == nil {
+		return OffsetNext
+	}
+	return *c.StreamOffset
+}
+
+// consumeArgs returns the arguments to consume the queue with, a
+// stream consumer resumes after the offset saved in the OffsetStore
+// if one has been saved, otherwise it starts from StreamOffset
+func (c *ConsumerConfig) consumeArgs(ctx context.Context, queueName string) (amqp.Table, error) {
+	a := amqp.Table{}
+	for k, v := range c.Args {
+		a[k] = v
+	}
+	if c.GetQueueType() != QueueTypeStream {
+		return a, nil
+	}
+
+	if c.OffsetStore != nil {
+		offset, ok, err := c.OffsetStore.Load(ctx, queueName)
+		if err != nil {
+			return nil, fmt.Errorf("loading offset for stream %s: %w", queueName, err)
+		}
+		if ok {
+			log.Infof("resuming stream %s after offset %d", queueName, offset)
+			a[StreamOffsetHeader] = offset + 1
+			return a, nil
+		}
+	}
+	offset, err := ParseStreamOffset(c.GetStreamOffset())
+	if err != nil {
+		return nil, err
+	}
+	a[StreamOffsetHeader] = offset
+	return a, nil
+}
+
+// flushOffsets writes offsets the store has buffered, if it
+// buffers them, once the host stops consuming a stream
+func flushOffsets(cfg *ConsumerConfig, queueName string) {
+	f, ok := cfg.OffsetStore.(interface{ Flush() error })
+	if !ok || cfg.GetQueueType() != QueueTypeStream {
+		return
+	}
+	if err := f.Flush(); err != nil {
+		log.Errorf("error writing offsets for stream %s: %s", queueName, err)
+	}
+}
+
+// trackOffset saves the offset of each stream message to
+// the store once it has been handled, whatever the outcome
+func trackOffset(cfg *ConsumerConfig, queueName string, h HandlerFunc) HandlerFunc {
+	store := cfg.OffsetStore
+	if store == nil || cfg.GetQueueType() != QueueTypeStream {
+		return h
+	}
+	return func(ctx context.Context, d amqp.Delivery) {
+		h(ctx, d)
+
+		var offset int64
+		switch o := d.Headers[StreamOffsetHeader].(type) {
+		case int64:
+			offset = o
+		case int32:
+			offset = int64(o)
+		default:
+			return
+		}
+		if err := store.Save(ctx, queueName, offset); err != nil {
+			log.Errorf("error saving offset %d for stream %s: %s", offset, queueName, err)
+		}
+	}
+}
+
+// OffsetStore records the offset of the last message handled from
+// each stream so consumption can resume from there after a restart
+// or reconnect
+type OffsetStore interface {
+	// Load returns the offset saved for the stream,
+	// false is returned if nothing has been saved
+	Load(ctx context.Context, stream string) (int64, bool, error)
+	// Save records the offset of the last message handled
+	Save(ctx context.Context, stream string, offset int64) error
+}
+
+// MemoryOffsetStore keeps offsets in memory, consumption resumes
+// after a reconnect but starts from StreamOffset after a restart.
+// The host uses one when a stream consumer has no OffsetStore
+type MemoryOffsetStore struct {
+	mu      *sync.Mutex
+	offsets map[string]int64
+}
+
+// NewMemoryOffsetStore returns an empty MemoryOffsetStore
+func NewMemoryOffsetStore() *MemoryOffsetStore {
+	return &MemoryOffsetStore{mu: &sync.Mutex{}, offsets: make(map[string]int64)}
+}
+
+// Load returns the offset saved for the stream
+func (s *MemoryOffsetStore) Load(ctx context.Context, stream string) (int64, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	o, ok := s.offsets[stream]
+	return o, ok, nil
+}
+
+// Save records the offset for the stream
+func (s *MemoryOffsetStore) Save(ctx context.Context, stream string, offset int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.offsets[stream] = offset
+	return nil
+}
+
+// fileOffsetInterval is how often a FileOffsetStore writes its file
+const fileOffsetInterval = time.Second
+
+// FileOffsetStore keeps offsets in a json file so consumption resumes
+// after a restart. Rather than on every save the file is written a
+// second after the first unwritten save, and when Flush is called.
+// It's replaced atomically so a crash never leaves it half written,
+// at most the last second of messages are handled again
+type FileOffsetStore struct {
+	mu      *sync.Mutex
+	path    string
+	offsets map[string]int64
+	// dirty is set when offsets have been saved but not
+	// written, timer writes them
+	dirty bool
+	timer *time.Timer
+}
+
+// NewFileOffsetStore returns a store using the file at path, offsets
+// already saved in the file are loaded. The file is created on first save
+func NewFileOffsetStore(path string) (*FileOffsetStore, error) {
+	s := &FileOffsetStore{mu: &sync.Mutex{}, path: path, offsets: make(map[string]int64)}
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, &s.offsets); err != nil {
+		return nil, fmt.Errorf("reading offsets from %s: %w", path, err)
+	}
+	return s, nil
+}
+
+// Load returns the offset saved for the stream
+func (s *FileOffsetStore) Load(ctx context.Context, stream string) (int64, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	o, ok := s.offsets[stream]
+	return o, ok, nil
+}
+
+// Save records the offset for the stream, the
+// file is written within a second
+func (s *FileOffsetStore) Save(ctx context.Context, stream string, offset int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.offsets[stream] = offset
+	s.dirty = true
+	if s.timer == nil {
+		s.timer = time.AfterFunc(fileOffsetInterval, func() {
+			if err := s.Flush(); err != nil {
+				log.Errorf("error writing stream offsets to %s: %s", s.path, err)
+			}
+		})
+	}
+	return nil
+}
+
+// Flush writes offsets saved since the file was last written, the host
+// calls it when it stops consuming a stream
+func (s *FileOffsetStore) Flush() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.timer != nil {
+		s.timer.Stop()
+		s.timer = nil
+	}
+	if !s.dirty {
+		return nil
+	}
+	if err := s.write(); err != nil {
+		return err
+	}
+	s.dirty = false
+	return nil
+}
+
+// write replaces the file with the offsets
+func (s *FileOffsetStore) write() error {
+	b, err := json.Marshal(s.offsets)
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(s.path), filepath.Base(s.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), s.path)
+}
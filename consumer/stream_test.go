@@ -0,0 +1,128 @@
+package consumer_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/streadway/amqp"
+	"github.com/theflyingcodr/rabbitmq/consumer"
+	"github.com/theflyingcodr/rabbitmq/memory"
+)
+
+// consumeRecorder wraps a connection sending the
+// arguments of each consume to args
+type consumeRecorder struct {
+	consumer.Connection
+	args chan amqp.Table
+}
+
+func (c *consumeRecorder) Channel() (consumer.Channel, error) {
+	ch, err := c.Connection.Channel()
+	if err != nil {
+		return nil, err
+	}
+	return &consumeRecorderChannel{Channel: ch, args: c.args}, nil
+}
+
+type consumeRecorderChannel struct {
+	consumer.Channel
+	args chan amqp.Table
+}
+
+func (c *consumeRecorderChannel) Consume(queue, tag string, autoAck, exclusive, noLocal, noWait bool, args amqp.Table) (<-chan amqp.Delivery, error) {
+	c.args <- args
+	return c.Channel.Consume(queue, tag, autoAck, exclusive, noLocal, noWait, args)
+}
+
+func TestStreamResumesAfterReconnectWithoutOffsetStore(t *testing.T) {
+	b := memory.NewBroker()
+	args := make(chan amqp.Table, 10)
+	initial := 10 * time.Millisecond
+	h := consumer.NewConsumerHost(&consumer.HostConfig{
+		Address: "mem",
+		Dial: func(address string) (consumer.Connection, error) {
+			conn, err := b.Dial(address)
+			if err != nil {
+				return nil, err
+			}
+			return &consumeRecorder{Connection: conn, args: args}, nil
+		},
+		Reconnect: &consumer.ReconnectPolicy{InitialDelay: &initial},
+	})
+	stream, prefetch := consumer.QueueTypeStream, uint(10)
+	handled := make(chan struct{}, 10)
+	h.AddBroker(context.Background(), &consumer.ExchangeConfig{Name: "ex"}, []consumer.Consumer{&testConsumer{
+		cfg:   &consumer.ConsumerConfig{Name: "s", QueueType: &stream, PrefetchCount: &prefetch},
+		queue: "s",
+		key:   "s",
+		handler: func(ctx context.Context, d amqp.Delivery) error {
+			handled <- struct{}{}
+			return nil
+		},
+	}})
+	if err := h.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer h.Stop(context.Background())
+
+	if a := <-args; a[consumer.StreamOffsetHeader] != consumer.OffsetNext {
+		t.Fatalf("first consume from %v, want next", a[consumer.StreamOffsetHeader])
+	}
+	conn, _ := b.Dial("mem")
+	ch, _ := conn.Channel()
+	ch.Publish("ex", "s", false, false, amqp.Publishing{Headers: amqp.Table{consumer.StreamOffsetHeader: int64(41)}})
+	conn.Close()
+	select {
+	case <-handled:
+	case <-time.After(time.Second):
+		t.Fatal("message not handled")
+	}
+
+	b.Disconnect()
+	select {
+	case a := <-args:
+		if a[consumer.StreamOffsetHeader] != int64(42) {
+			t.Fatalf("resumed from %v, want 42", a[consumer.StreamOffsetHeader])
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("didn't consume after reconnecting")
+	}
+}
+
+func TestFileOffsetStoreBatchesWrites(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "offsets.json")
+	s, err := consumer.NewFileOffsetStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	for i := int64(0); i < 100; i++ {
+		if err := s.Save(ctx, "s", i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatal("file written on save")
+	}
+	if err := s.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	reopened, err := consumer.NewFileOffsetStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if o, ok, _ := reopened.Load(ctx, "s"); !ok || o != 99 {
+		t.Fatalf("loaded %d %v, want 99", o, ok)
+	}
+
+	// saves are written without a flush within a second
+	s.Save(ctx, "s", 100)
+	time.Sleep(1200 * time.Millisecond)
+	reopened, _ = consumer.NewFileOffsetStore(path)
+	if o, _, _ := reopened.Load(ctx, "s"); o != 100 {
+		t.Fatalf("loaded %d, want 100", o)
+	}
+}
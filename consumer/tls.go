@@ -0,0 +1,165 @@
+package consumer
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+var (
+	ERRINVALIDTLSCONFIG = errors.New("invalid tls config")
+)
+
+// Mechanisms the host can authenticate with, set with
+// HostConfig.AuthMechanism
+const (
+	// AuthPlain sends the username & password in the address
+	AuthPlain = "plain"
+	// AuthExternal authenticates with the client certificate,
+	// the broker needs the rabbitmq_auth_mechanism_ssl plugin
+	AuthExternal = "external"
+)
+
+// tlsVersions maps the versions accepted by TLSConfig.MinVersion
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// TLSConfig sets up the tls connection to brokers with
+// an amqps:// address. Files are read when the host connects
+type TLSConfig struct {
+	// CAFile is a pem bundle of the certificate authorities the
+	// broker's certificate is checked against, if empty the
+	// system's are used
+	CAFile string `json:"ca_file"`
+	// CertFile & KeyFile are the pem client certificate and key
+	// presented to the broker, both or neither must be set
+	CertFile string `json:"cert_file"`
+	KeyFile  string `json:"key_file"`
+	// ServerName is checked against the broker's certificate,
+	// if empty the host of the address is used
+	ServerName string `json:"server_name"`
+	// MinVersion is the lowest tls version accepted, one of
+	// 1.0, 1.1, 1.2 or 1.3, defaults to 1.2
+	MinVersion *string `json:"min_version"`
+}
+
+// GetMinVersion returns the lowest tls version accepted,
+// if nil then it returns a default of 1.2
+func (t *TLSConfig) GetMinVersion() string {
+	if t.MinVersion == nil {
+		return "1.2"
+	}
+	return *t.MinVersion
+}
+
+// Config builds the tls.Config, loading the CA bundle
+// and client certificate from their files
+func (t *TLSConfig) Config() (*tls.Config, error) {
+	v, ok := tlsVersions[t.GetMinVersion()]
+	if !ok {
+		return nil, fmt.Errorf("%w: min_version %q must be one of 1.0, 1.1, 1.2 or 1.3", ERRINVALIDTLSCONFIG, t.GetMinVersion())
+	}
+	c := &tls.Config{
+		ServerName: t.ServerName,
+		MinVersion: v,
+	}
+
+	if t.CAFile != "" {
+		pem, err := os.ReadFile(t.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("%w: ca_file: %w", ERRINVALIDTLSCONFIG, err)
+		}
+		c.RootCAs = x509.NewCertPool()
+		if !c.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("%w: ca_file %s has no pem certificates", ERRINVALIDTLSCONFIG, t.CAFile)
+		}
+	}
+
+	if (t.CertFile == "") != (t.KeyFile == "") {
+		return nil, fmt.Errorf("%w: cert_file and key_file must be set together", ERRINVALIDTLSCONFIG)
+	}
+	if t.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(t.CertFile, t.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("%w: client certificate: %w", ERRINVALIDTLSCONFIG, err)
+		}
+		c.Certificates = []tls.Certificate{cert}
+	}
+	return c, nil
+}
+
+// externalAuth is the SASL EXTERNAL mechanism, the broker takes
+// the username from the client certificate so the response is empty
+type externalAuth struct{}
+
+func (externalAuth) Mechanism() string {
+	return "EXTERNAL"
+}
+
+func (externalAuth) Response() string {
+	return ""
+}
+
+// AMQPConfig builds the config the default Dialer connects with
+// from TLS & AuthMechanism. TLS is only used for amqps:// addresses
+// so it's an error to set it, or to use AuthExternal, without them
+func (c *HostConfig) AMQPConfig() (amqp.Config, error) {
+	cfg := amqp.Config{
+		Heartbeat: 10 * time.Second,
+		Locale:    "en_US",
+	}
+
+	if c.TLS != nil || c.GetAuthMechanism() == AuthExternal {
+		for _, a := range c.GetAddresses() {
+			if u, err := url.Parse(a); err == nil && u.Scheme != "amqps" {
+				return cfg, fmt.Errorf("%w: %s isn't an amqps:// address", ERRINVALIDTLSCONFIG, redact(a))
+			}
+		}
+	}
+	if c.TLS != nil {
+		t, err := c.TLS.Config()
+		if err != nil {
+			return cfg, err
+		}
+		cfg.TLSClientConfig = t
+	}
+
+	switch c.GetAuthMechanism() {
+	case AuthPlain:
+		// the credentials in the address are used
+	case AuthExternal:
+		if c.TLS == nil || c.TLS.CertFile == "" {
+			return cfg, fmt.Errorf("%w: auth_mechanism %s needs a client certificate", ERRINVALIDTLSCONFIG, AuthExternal)
+		}
+		cfg.SASL = []amqp.Authentication{externalAuth{}}
+	default:
+		return cfg, fmt.Errorf("%w: auth_mechanism %q must be one of %s or %s", ERRINVALIDTLSCONFIG, c.GetAuthMechanism(), AuthPlain, AuthExternal)
+	}
+	return cfg, nil
+}
+
+// dialer returns Dial if it's set, otherwise a Dialer configured
+// by AMQPConfig, or an error if the config is invalid
+func (c *HostConfig) dialer() (Dialer, error) {
+	if c.Dial != nil {
+		return c.Dial, nil
+	}
+	if c.TLS == nil && c.AuthMechanism == nil {
+		return DialAMQP, nil
+	}
+	cfg, err := c.AMQPConfig()
+	if err != nil {
+		return nil, err
+	}
+	return DialAMQPConfig(cfg), nil
+}
@@ -0,0 +1,142 @@
+package consumer_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/theflyingcodr/rabbitmq/consumer"
+)
+
+// certificate writes a pem certificate & key for name to dir, signed
+// by parent or self signed if parent is nil, returning the file names
+func certificate(t *testing.T, dir, name string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey, string, string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		DNSNames:     []string{name},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+	}
+	if parent == nil {
+		tmpl.IsCA, tmpl.BasicConstraintsValid = true, true
+		parent, parentKey = tmpl, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kb, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile := filepath.Join(dir, name+".pem"), filepath.Join(dir, name+".key")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: kb}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return cert, key, certFile, keyFile
+}
+
+func TestTLSPresentsClientCertificate(t *testing.T) {
+	dir := t.TempDir()
+	ca, caKey, caFile, _ := certificate(t, dir, "ca", nil, nil)
+	_, _, serverCert, serverKey := certificate(t, dir, "localhost", ca, caKey)
+	_, _, clientCert, clientKey := certificate(t, dir, "client", ca, caKey)
+
+	pair, err := tls.LoadX509KeyPair(serverCert, serverKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(ca)
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{pair},
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	client := make(chan string, 1)
+	go func() {
+		c, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		tc := c.(*tls.Conn)
+		if err := tc.Handshake(); err == nil {
+			client <- tc.ConnectionState().PeerCertificates[0].Subject.CommonName
+		}
+	}()
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+
+	// the listener isn't a broker so the dial fails after the handshake
+	ext := consumer.AuthExternal
+	cfg := &consumer.HostConfig{
+		Address:       "amqps://localhost:" + port + "/",
+		AuthMechanism: &ext,
+		TLS:           &consumer.TLSConfig{CAFile: caFile, CertFile: clientCert, KeyFile: clientKey},
+	}
+	cfg.GetDial()(cfg.Address)
+	select {
+	case cn := <-client:
+		if cn != "client" {
+			t.Fatalf("presented %s, want client", cn)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("no handshake")
+	}
+}
+
+func TestInvalidTLSConfig(t *testing.T) {
+	dir := t.TempDir()
+	_, _, certFile, keyFile := certificate(t, dir, "client", nil, nil)
+	ext := consumer.AuthExternal
+	version := "1.4"
+	tests := map[string]*consumer.HostConfig{
+		"tls without amqps":     {Address: "amqp://localhost/", TLS: &consumer.TLSConfig{}},
+		"external without cert": {Address: "amqps://localhost/", AuthMechanism: &ext},
+		"unknown min version":   {Address: "amqps://localhost/", TLS: &consumer.TLSConfig{MinVersion: &version}},
+		"cert without key":      {Address: "amqps://localhost/", TLS: &consumer.TLSConfig{CertFile: certFile}},
+		"ca file without certs": {Address: "amqps://localhost/", TLS: &consumer.TLSConfig{CAFile: keyFile}},
+		"missing ca file":       {Address: "amqps://localhost/", TLS: &consumer.TLSConfig{CAFile: filepath.Join(dir, "missing.pem")}},
+		"one address not amqps": {Address: "amqps://a/", Addresses: []string{"amqp://b/"}, TLS: &consumer.TLSConfig{}},
+	}
+	for name, cfg := range tests {
+		t.Run(name, func(t *testing.T) {
+			if _, err := cfg.AMQPConfig(); !errors.Is(err, consumer.ERRINVALIDTLSCONFIG) {
+				t.Fatalf("got %v, want invalid tls config", err)
+			}
+			if _, err := cfg.GetDial()(cfg.Address); !errors.Is(err, consumer.ERRINVALIDTLSCONFIG) {
+				t.Fatalf("dial got %v, want invalid tls config", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,32 @@
+package consumer_test
+
+import (
+	"testing"
+
+	"github.com/theflyingcodr/rabbitmq/consumer"
+)
+
+func TestMatchTopic(t *testing.T) {
+	tests := []struct {
+		pattern, key string
+		want         bool
+	}{
+		{"a.b", "a.b", true},
+		{"a.b", "a.c", false},
+		{"a.*", "a.b", true},
+		{"a.*", "a.b.c", false},
+		{"a.*", "a", false},
+		{"a.#", "a", true},
+		{"a.#", "a.b.c", true},
+		{"#", "", true},
+		{"#.c", "a.b.c", true},
+		{"a.#.c", "a.c", true},
+		{"a.#.c", "a.b.d", false},
+		{"*.b.#", "a.b", true},
+	}
+	for _, tt := range tests {
+		if got := consumer.MatchTopic(tt.pattern, tt.key); got != tt.want {
+			t.Errorf("MatchTopic(%q, %q) = %v, want %v", tt.pattern, tt.key, got, tt.want)
+		}
+	}
+}
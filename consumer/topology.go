@@ -0,0 +1,344 @@
+package consumer
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Topology file formats
+const (
+	TopologyYAML = "yaml"
+	TopologyJSON = "json"
+)
+
+var (
+	ERRINVALIDTOPOLOGY = errors.New("invalid topology")
+)
+
+// Topology describes exchanges and the queues bound to them so
+// they can be declared from a file rather than in code, handlers
+// are still registered in code by queue name with Register
+//
+//	brokers:
+//	  - exchange:
+//	      name: orders
+//	    consumers:
+//	      billing:
+//	        prefetch_count: 10
+//	        retry:
+//	          max_attempts: 3
+//	          backoff: [5s, 30s]
+//	    queues:
+//	      orders.created:
+//	        consumer: billing
+//	        keys: [orders.created]
+//	        config:
+//	          ttl: 60000
+type Topology struct {
+	Brokers []BrokerConfig `json:"brokers"`
+}
+
+// BrokerConfig is an exchange and the queues bound to it
+type BrokerConfig struct {
+	Exchange ExchangeConfig `json:"exchange"`
+	// Consumers are named configs queues take their defaults from,
+	// other than Name so each queue gets its own deadletter queue
+	Consumers map[string]ConsumerConfig `json:"consumers"`
+	// Queues are the queues bound to the exchange keyed by name
+	Queues map[string]QueueConfig `json:"queues"`
+}
+
+// QueueConfig is a queue in a topology, its bindings
+// and any config overriding its consumer's
+type QueueConfig struct {
+	// Consumer is the key of the entry in Consumers the queue takes its
+	// defaults from, if empty the queue uses the default ConsumerConfig.
+	// Either way the queue is named after its key unless Config sets Name
+	Consumer     string                 `json:"consumer"`
+	Keys         []string               `json:"keys"`
+	Headers      map[string]interface{} `json:"headers"`
+	HeadersMatch string                 `json:"headers_match"`
+	Config       *ConsumerConfig        `json:"config"`
+}
+
+// Handlers maps queue names in a topology to their handlers
+type Handlers map[string]KeyHandlerFunc
+
+// LoadTopology reads a topology from a yaml or json file,
+// the format is taken from the extension. It is validated
+// before being returned
+func LoadTopology(path string) (*Topology, error) {
+	var format string
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		format = TopologyYAML
+	case ".json":
+		format = TopologyJSON
+	default:
+		return nil, fmt.Errorf("unknown topology file type %s, expected .yaml, .yml or .json", path)
+	}
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	t, err := ParseTopology(b, format)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return t, nil
+}
+
+// ParseTopology decodes a topology in the format provided and
+// validates it. Unknown fields are an error so typos aren't ignored
+func ParseTopology(b []byte, format string) (*Topology, error) {
+	switch format {
+	case TopologyJSON:
+	case TopologyYAML:
+		// decode yaml generically and re-encode it as json so both
+		// formats share the json field names and decoding rules
+		var v interface{}
+		if err := yaml.Unmarshal(b, &v); err != nil {
+			return nil, err
+		}
+		var err error
+		if b, err = json.Marshal(yamlToJSON(v)); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unknown topology format %q, expected %s or %s", format, TopologyYAML, TopologyJSON)
+	}
+
+	t := &Topology{}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	dec.UseNumber()
+	if err := dec.Decode(t); err != nil {
+		return nil, err
+	}
+	t.normalise()
+	if err := t.Validate(); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// Validate checks every exchange, consumer and queue in the topology,
+// all of the problems found are returned joined together, each wraps
+// ERRINVALIDTOPOLOGY
+func (t *Topology) Validate() error {
+	errs := make([]error, 0)
+	fail := func(format string, a ...interface{}) {
+		errs = append(errs, fmt.Errorf("%w: %s", ERRINVALIDTOPOLOGY, fmt.Sprintf(format, a...)))
+	}
+
+	queues := make(map[string]string)
+	for i, b := range t.Brokers {
+		ex := b.Exchange.Name
+		if ex == "" {
+			fail("broker %d: %s", i, ERRNAMEREQUIRED)
+			ex = fmt.Sprintf("broker %d", i)
+		}
+		switch b.Exchange.GetType() {
+		case TOPIC_EXCHANGE, DIRECT_EXCHANGE, FANOUT_EXCHANGE, HEADERS_EXCHANGE:
+		default:
+			fail("exchange %s: %s, got %q", ex, ERRINVALIDEXCHANGETYPE, b.Exchange.GetType())
+		}
+		for _, eb := range b.Exchange.Bindings {
+			if eb.Source == "" {
+				fail("exchange %s: binding has no source exchange", ex)
+			}
+		}
+
+		for _, name := range sortedKeys(b.Queues) {
+			q := b.Queues[name]
+			if other, ok := queues[name]; ok {
+				fail("queue %s is bound to both exchange %s and %s", name, other, ex)
+			}
+			queues[name] = ex
+
+			if q.Consumer != "" {
+				if _, ok := b.Consumers[q.Consumer]; !ok {
+					fail("queue %s: exchange %s has no consumer named %s", name, ex, q.Consumer)
+					continue
+				}
+			}
+			if _, err := q.routes(nil).Bindings(b.Exchange.GetType()); err != nil {
+				fail("queue %s: %s", name, err)
+			}
+			if err := b.queueConfig(name, q).Validate(); err != nil {
+				fail("queue %s: %s", name, err)
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Register adds each exchange in the topology to the host with a consumer
+// for its queues, handlers provides the handler for every queue by name.
+// An error is returned if a queue has no handler or a handler has no queue
+func (t *Topology) Register(ctx context.Context, h Host, handlers Handlers) error {
+	seen := make(map[string]bool)
+	for _, b := range t.Brokers {
+		for name := range b.Queues {
+			if handlers[name] == nil {
+				return fmt.Errorf("%w: no handler registered for queue %s", ERRINVALIDTOPOLOGY, name)
+			}
+			seen[name] = true
+		}
+	}
+	for name := range handlers {
+		if !seen[name] {
+			return fmt.Errorf("%w: handler registered for queue %s which isn't in the topology", ERRINVALIDTOPOLOGY, name)
+		}
+	}
+
+	for i := range t.Brokers {
+		b := &t.Brokers[i]
+		if err := h.AddBroker(ctx, &b.Exchange, []Consumer{b.consumer(handlers)}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// consumer returns the Consumer for the broker's queues
+// with the handler registered for each queue
+func (b *BrokerConfig) consumer(handlers Handlers) Consumer {
+	c := &topologyConsumer{routes: make(map[string]*Routes)}
+	for name, q := range b.Queues {
+		r := q.routes(handlers[name])
+		r.Config = b.queueConfig(name, q)
+		c.routes[name] = r
+	}
+	return c
+}
+
+// queueConfig returns the queue's config merged over
+// the consumer it uses, or over the defaults if it has none
+func (b *BrokerConfig) queueConfig(name string, q QueueConfig) *ConsumerConfig {
+	base := &ConsumerConfig{}
+	if c, ok := b.Consumers[q.Consumer]; ok && q.Consumer != "" {
+		base = &c
+	}
+	// named after the queue rather than the consumer so queues
+	// sharing a consumer don't share its deadletter queue
+	base.Name = name
+	return base.Merge(q.Config)
+}
+
+func (q QueueConfig) routes(h KeyHandlerFunc) *Routes {
+	return &Routes{
+		Keys:         q.Keys,
+		Headers:      q.Headers,
+		HeadersMatch: q.HeadersMatch,
+		DeliveryFunc: h,
+	}
+}
+
+// topologyConsumer is the Consumer registered for the queues
+// of an exchange in a topology, each queue carries its own config
+type topologyConsumer struct {
+	routes map[string]*Routes
+}
+
+func (c *topologyConsumer) Init() (*ConsumerConfig, error) {
+	return &ConsumerConfig{}, nil
+}
+
+func (c *topologyConsumer) Prefix() string {
+	return ""
+}
+
+func (c *topologyConsumer) Middleware(h HandlerFunc) HandlerFunc {
+	return h
+}
+
+func (c *topologyConsumer) Queues(context.Context) map[string]*Routes {
+	return c.routes
+}
+
+// normalise converts the numbers decoded into argument
+// tables to the integer or float types amqp can encode
+func (t *Topology) normalise() {
+	for i := range t.Brokers {
+		b := &t.Brokers[i]
+		normaliseTable(b.Exchange.Args)
+		for _, eb := range b.Exchange.Bindings {
+			normaliseTable(eb.Args)
+		}
+		for _, c := range b.Consumers {
+			normaliseTable(c.Args)
+		}
+		for _, q := range b.Queues {
+			normaliseTable(q.Headers)
+			if q.Config != nil {
+				normaliseTable(q.Config.Args)
+			}
+		}
+	}
+}
+
+func normaliseTable(t map[string]interface{}) {
+	for k, v := range t {
+		t[k] = normaliseValue(v)
+	}
+}
+
+func normaliseValue(v interface{}) interface{} {
+	switch n := v.(type) {
+	case json.Number:
+		if i, err := n.Int64(); err == nil {
+			return i
+		}
+		f, _ := n.Float64()
+		return f
+	case map[string]interface{}:
+		normaliseTable(n)
+		return n
+	case []interface{}:
+		for i := range n {
+			n[i] = normaliseValue(n[i])
+		}
+		return n
+	}
+	return v
+}
+
+// yamlToJSON converts the map[interface{}]interface{} maps
+// yaml decodes into map[string]interface{} so they can be
+// encoded as json
+func yamlToJSON(v interface{}) interface{} {
+	switch t := v.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(t))
+		for k, v := range t {
+			m[fmt.Sprint(k)] = yamlToJSON(v)
+		}
+		return m
+	case []interface{}:
+		for i := range t {
+			t[i] = yamlToJSON(t[i])
+		}
+		return t
+	}
+	return v
+}
+
+func sortedKeys(m map[string]QueueConfig) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,125 @@
+package consumer_test
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/streadway/amqp"
+	"github.com/theflyingcodr/rabbitmq/consumer"
+	"github.com/theflyingcodr/rabbitmq/memory"
+)
+
+const topology = `
+brokers:
+  - exchange:
+      name: orders
+      alternate_exchange: orders.unrouted
+    consumers:
+      billing:
+        prefetch_count: 10
+        retry:
+          max_attempts: 2
+          backoff: [100ms, 200ms]
+    queues:
+      orders.created:
+        consumer: billing
+        keys: [orders.created]
+        config:
+          ttl: 60000
+      orders.refunded:
+        consumer: billing
+        keys: [orders.refunded]
+      orders.audit:
+        keys: ["orders.#"]
+  - exchange:
+      name: events
+      type: headers
+    queues:
+      events.eu:
+        headers: {region: eu}
+`
+
+func TestParseTopologyErrors(t *testing.T) {
+	_, err := consumer.ParseTopology([]byte(`{"brokers":[{
+		"exchange":{"name":"x","type":"bogus"},
+		"queues":{"a":{"consumer":"nope"},"b":{"config":{"overflow":"drop-head"}}}
+	}]}`), consumer.TopologyJSON)
+	if !errors.Is(err, consumer.ERRINVALIDTOPOLOGY) {
+		t.Fatalf("got %v, want invalid topology", err)
+	}
+	for _, want := range []string{"bogus", "no consumer named nope", "queue b"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("%v doesn't mention %s", err, want)
+		}
+	}
+
+	if _, err := consumer.ParseTopology([]byte("brokers:\n - exchange: {name: x, typo: 1}\n"), consumer.TopologyYAML); err == nil {
+		t.Fatal("unknown field accepted")
+	}
+}
+
+func TestTopologyRegister(t *testing.T) {
+	top, err := consumer.ParseTopology([]byte(topology), consumer.TopologyYAML)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := memory.NewBroker()
+	h := consumer.NewConsumerHost(&consumer.HostConfig{Address: "mem", Dial: b.Dial})
+	handled := make(chan string, 10)
+	handler := func(name string) consumer.KeyHandlerFunc {
+		return func(ctx context.Context, d amqp.Delivery) error {
+			handled <- name
+			return nil
+		}
+	}
+	if err := top.Register(context.Background(), h, consumer.Handlers{"orders.created": handler("orders.created")}); !errors.Is(err, consumer.ERRINVALIDTOPOLOGY) {
+		t.Fatalf("got %v, want an error for the missing handlers", err)
+	}
+	err = top.Register(context.Background(), h, consumer.Handlers{
+		"orders.created":  handler("orders.created"),
+		"orders.refunded": handler("orders.refunded"),
+		"orders.audit":    handler("orders.audit"),
+		"events.eu":       handler("events.eu"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := h.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { h.Stop(context.Background()) })
+
+	for _, q := range []string{"orders.unrouted", "orders.created.deadletter", "orders.refunded.deadletter", "orders.audit.deadletter", "orders.created.retry.100", "orders.created.retry.200"} {
+		if _, ok := b.Queue(q); !ok {
+			t.Errorf("queue %s wasn't declared", q)
+		}
+	}
+	// queues sharing a consumer don't share its name
+	if _, ok := b.Queue("billing.deadletter"); ok {
+		t.Error("queues using billing share its deadletter queue")
+	}
+
+	conn, err := b.Dial("mem")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	ch, err := conn.Channel()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ch.Publish("orders", "orders.created", false, false, amqp.Publishing{})
+	ch.Publish("events", "", false, false, amqp.Publishing{Headers: amqp.Table{"region": "eu"}})
+	got := map[string]bool{}
+	for len(got) < 3 {
+		select {
+		case q := <-handled:
+			got[q] = true
+		case <-time.After(time.Second):
+			t.Fatalf("handled %v, want orders.created, orders.audit & events.eu", got)
+		}
+	}
+}
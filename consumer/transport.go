@@ -0,0 +1,82 @@
+package consumer
+
+import (
+	"github.com/streadway/amqp"
+)
+
+// Connection is the connection to a broker used by the Host.
+// Connections dialed with DialAMQP talk to RabbitMq, the memory
+// package provides an in memory broker which can be used in tests
+type Connection interface {
+	Channel() (Channel, error)
+	NotifyClose(chan *amqp.Error) chan *amqp.Error
+	Close() error
+}
+
+// Channel contains the methods of *amqp.Channel used
+// to setup exchanges & queues, consume and publish
+type Channel interface {
+	Qos(prefetchCount, prefetchSize int, global bool) error
+	ExchangeDeclare(name, kind string, durable, autoDelete, internal, noWait bool, args amqp.Table) error
+	ExchangeDeclarePassive(name, kind string, durable, autoDelete, internal, noWait bool, args amqp.Table) error
+	ExchangeBind(destination, key, source string, noWait bool, args amqp.Table) error
+	QueueDeclare(name string, durable, autoDelete, exclusive, noWait bool, args amqp.Table) (amqp.Queue, error)
+	QueueDeclarePassive(name string, durable, autoDelete, exclusive, noWait bool, args amqp.Table) (amqp.Queue, error)
+	QueueDelete(name string, ifUnused, ifEmpty, noWait bool) (int, error)
+	QueueBind(name, key, exchange string, noWait bool, args amqp.Table) error
+	Consume(queue, consumer string, autoAck, exclusive, noLocal, noWait bool, args amqp.Table) (<-chan amqp.Delivery, error)
+	Cancel(consumer string, noWait bool) error
+	Publish(exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error
+	Get(queue string, autoAck bool) (amqp.Delivery, bool, error)
+	Confirm(noWait bool) error
+	NotifyPublish(chan amqp.Confirmation) chan amqp.Confirmation
+	NotifyReturn(chan amqp.Return) chan amqp.Return
+	NotifyClose(chan *amqp.Error) chan *amqp.Error
+	NotifyCancel(chan string) chan string
+	Close() error
+}
+
+// Dialer opens a Connection to the broker at the address
+// provided, HostConfig.Dial can be set to replace the default
+// of DialAMQP
+type Dialer func(address string) (Connection, error)
+
+// DialAMQP connects to a RabbitMq broker using streadway/amqp
+func DialAMQP(address string) (Connection, error) {
+	conn, err := amqp.Dial(address)
+	if err != nil {
+		return nil, err
+	}
+	return &amqpConnection{conn}, nil
+}
+
+// DialAMQPConfig returns a Dialer which connects to a RabbitMq
+// broker with config, amqps:// addresses use its TLSClientConfig
+func DialAMQPConfig(config amqp.Config) Dialer {
+	return func(address string) (Connection, error) {
+		cfg := config
+		if cfg.TLSClientConfig != nil {
+			// amqp sets an empty ServerName to the host dialed,
+			// copy it so each node of a cluster is checked by name
+			cfg.TLSClientConfig = cfg.TLSClientConfig.Clone()
+		}
+		conn, err := amqp.DialConfig(address, cfg)
+		if err != nil {
+			return nil, err
+		}
+		return &amqpConnection{conn}, nil
+	}
+}
+
+// amqpConnection adapts *amqp.Connection to Connection
+type amqpConnection struct {
+	*amqp.Connection
+}
+
+func (c *amqpConnection) Channel() (Channel, error) {
+	ch, err := c.Connection.Channel()
+	if err != nil {
+		return nil, err
+	}
+	return ch, nil
+}
@@ -0,0 +1,97 @@
+// Package deadletter inspects and replays messages held in
+// deadletter queues.
+//
+// Messages are read with basic.get so no consumer is needed and
+// the queue's own consumers, if any, are left alone
+//
+//	ch, _ := conn.Channel()
+//	replayed, err := deadletter.NewClient(ch).Replay(ctx, "orders.deadletter", deadletter.Filter{
+//		RoutingKey: "orders.#",
+//		Reason:     deadletter.Rejected,
+//	}, 100)
+package deadletter
+
+import (
+	"time"
+
+	"github.com/streadway/amqp"
+	"github.com/theflyingcodr/rabbitmq/consumer"
+)
+
+// Reasons a message is dead-lettered, as recorded in x-death
+const (
+	Rejected      = "rejected"
+	Expired       = "expired"
+	MaxLen        = "maxlen"
+	DeliveryLimit = "delivery_limit"
+)
+
+// Death is an entry in the x-death header added each
+// time a message is dead-lettered from a queue
+type Death struct {
+	Queue       string    `json:"queue"`
+	Reason      string    `json:"reason"`
+	Count       int64     `json:"count"`
+	Time        time.Time `json:"time"`
+	Exchange    string    `json:"exchange"`
+	RoutingKeys []string  `json:"routing_keys"`
+}
+
+// Deaths decodes the x-death header of d, the most
+// recent death is first
+func Deaths(d amqp.Delivery) []Death {
+	entries, _ := d.Headers["x-death"].([]interface{})
+	deaths := make([]Death, 0, len(entries))
+	for _, e := range entries {
+		t, ok := e.(amqp.Table)
+		if !ok {
+			continue
+		}
+		death := Death{}
+		death.Queue, _ = t["queue"].(string)
+		death.Reason, _ = t["reason"].(string)
+		death.Exchange, _ = t["exchange"].(string)
+		death.Time, _ = t["time"].(time.Time)
+		switch c := t["count"].(type) {
+		case int64:
+			death.Count = c
+		case int32:
+			death.Count = int64(c)
+		case int:
+			death.Count = int64(c)
+		}
+		keys, _ := t["routing-keys"].([]interface{})
+		for _, k := range keys {
+			if s, ok := k.(string); ok {
+				death.RoutingKeys = append(death.RoutingKeys, s)
+			}
+		}
+		deaths = append(deaths, death)
+	}
+	return deaths
+}
+
+// Origin returns the exchange and routing key d was published with
+// before it was dead-lettered. Messages that went through a retry
+// queue carry their original routing in headers, otherwise the most
+// recent x-death entry is used. false is returned if neither is present
+func Origin(d amqp.Delivery) (string, string, bool) {
+	if key, ok := d.Headers[consumer.OriginalRoutingKeyHeader].(string); ok {
+		ex, _ := d.Headers[consumer.OriginalExchangeHeader].(string)
+		return ex, key, true
+	}
+	deaths := Deaths(d)
+	if len(deaths) == 0 || len(deaths[0].RoutingKeys) == 0 {
+		return "", "", false
+	}
+	return deaths[0].Exchange, deaths[0].RoutingKeys[0], true
+}
+
+// Reason returns why d was most recently dead-lettered
+func Reason(d amqp.Delivery) string {
+	deaths := Deaths(d)
+	if len(deaths) == 0 {
+		return ""
+	}
+	return deaths[0].Reason
+}
@@ -0,0 +1,90 @@
+package deadletter
+
+import (
+	"context"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+// Message is a dead-lettered message read by Inspect
+type Message struct {
+	// Exchange & RoutingKey are where the message was
+	// originally published, see Origin
+	Exchange   string `json:"exchange"`
+	RoutingKey string `json:"routing_key"`
+	// Reason is why the message was most recently dead-lettered
+	Reason string `json:"reason"`
+	// Deaths is the decoded x-death header, most recent first
+	Deaths      []Death    `json:"deaths"`
+	Headers     amqp.Table `json:"headers"`
+	ContentType string     `json:"content_type,omitempty"`
+	MessageId   string     `json:"message_id,omitempty"`
+	Timestamp   time.Time  `json:"timestamp"`
+	Body        []byte     `json:"-"`
+}
+
+// Preview returns the body as a string cut to n bytes, a
+// negative n returns the whole body
+func (m Message) Preview(n int) string {
+	if n < 0 || len(m.Body) <= n {
+		return string(m.Body)
+	}
+	return string(m.Body[:n]) + "..."
+}
+
+// Inspect peeks at up to limit messages from the front of the queue,
+// a limit of 0 reads every message. Messages are read without being
+// acked and requeued afterwards so the queue is left as it was,
+// although RabbitMq will mark them as redelivered
+func (c *Client) Inspect(ctx context.Context, queue string, limit int) ([]Message, error) {
+	if queue == "" {
+		return nil, ERRQUEUEREQUIRED
+	}
+	q, err := c.ch.QueueDeclarePassive(queue, false, false, false, false, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	deliveries := make([]amqp.Delivery, 0)
+	defer func() {
+		for i := len(deliveries) - 1; i >= 0; i-- {
+			deliveries[i].Nack(false, true)
+		}
+	}()
+
+	messages := make([]Message, 0)
+	for i := 0; i < q.Messages && (limit <= 0 || i < limit); i++ {
+		if err := ctx.Err(); err != nil {
+			return messages, err
+		}
+		d, ok, err := c.ch.Get(queue, false)
+		if err != nil {
+			return messages, err
+		}
+		if !ok {
+			break
+		}
+		deliveries = append(deliveries, d)
+		messages = append(messages, message(d))
+	}
+	return messages, nil
+}
+
+// message decodes a delivery into a Message
+func message(d amqp.Delivery) Message {
+	m := Message{
+		Reason:      Reason(d),
+		Deaths:      Deaths(d),
+		Headers:     d.Headers,
+		ContentType: d.ContentType,
+		MessageId:   d.MessageId,
+		Timestamp:   d.Timestamp,
+		Body:        d.Body,
+	}
+	if ex, key, ok := Origin(d); ok {
+		m.Exchange = ex
+		m.RoutingKey = key
+	}
+	return m
+}
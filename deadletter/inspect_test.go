@@ -0,0 +1,166 @@
+package deadletter_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/streadway/amqp"
+	"github.com/theflyingcodr/rabbitmq/consumer"
+	"github.com/theflyingcodr/rabbitmq/deadletter"
+	"github.com/theflyingcodr/rabbitmq/memory"
+)
+
+// deadLettered sets up queue q on exchange ex dead-lettering to dlq and
+// fills dlq with c.1 rejected twice, a.1 rejected, b.1 expired and
+// d.1 rejected after being retried from orders.created
+func deadLettered(t *testing.T) (*memory.Broker, consumer.Channel) {
+	t.Helper()
+	b := memory.NewBroker()
+	conn, err := b.Dial("mem")
+	must(t, err)
+	t.Cleanup(func() { conn.Close() })
+	ch, err := conn.Channel()
+	must(t, err)
+	must(t, ch.ExchangeDeclare("ex", "topic", true, false, false, false, nil))
+	must(t, ch.ExchangeDeclare("dlx", "topic", true, false, false, false, nil))
+	_, err = ch.QueueDeclare("q", true, false, false, false, amqp.Table{"x-dead-letter-exchange": "dlx"})
+	must(t, err)
+	_, err = ch.QueueDeclare("dlq", true, false, false, false, nil)
+	must(t, err)
+	must(t, ch.QueueBind("q", "#", "ex", false, nil))
+	must(t, ch.QueueBind("dlq", "#", "dlx", false, nil))
+
+	reject := func(queue string) amqp.Delivery {
+		d, ok, err := ch.Get(queue, false)
+		if !ok || err != nil {
+			t.Fatal(ok, err)
+		}
+		must(t, d.Nack(false, false))
+		return d
+	}
+
+	// rejected, replayed then rejected again
+	must(t, ch.Publish("ex", "c.1", false, false, amqp.Publishing{Body: []byte("c.1")}))
+	reject("q")
+	d, ok, err := ch.Get("dlq", true)
+	if !ok || err != nil {
+		t.Fatal(ok, err)
+	}
+	must(t, ch.Publish("ex", "c.1", false, false, amqp.Publishing{Headers: d.Headers, Body: d.Body}))
+	reject("q")
+
+	must(t, ch.Publish("ex", "a.1", false, false, amqp.Publishing{Body: []byte("a message body"), MessageId: "a"}))
+	reject("q")
+
+	must(t, ch.Publish("ex", "b.1", false, false, amqp.Publishing{Body: []byte("b.1"), Expiration: "1"}))
+	deadline := time.Now().Add(time.Second)
+	for q, _ := b.Queue("dlq"); q.Ready < 3; q, _ = b.Queue("dlq") {
+		if time.Now().After(deadline) {
+			t.Fatal("b.1 didn't expire")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	must(t, ch.Publish("ex", "q.retry.100", false, false, amqp.Publishing{Body: []byte("d.1"), Headers: amqp.Table{
+		consumer.OriginalExchangeHeader:   "orders",
+		consumer.OriginalRoutingKeyHeader: "orders.created",
+	}}))
+	reject("q")
+	return b, ch
+}
+
+func TestInspect(t *testing.T) {
+	b, ch := deadLettered(t)
+	c := deadletter.NewClient(ch)
+
+	messages, err := c.Inspect(context.Background(), "dlq", 0)
+	must(t, err)
+	tests := []struct {
+		exchange, key, reason string
+		count                 int64
+	}{
+		{"ex", "c.1", deadletter.Rejected, 2},
+		{"ex", "a.1", deadletter.Rejected, 1},
+		{"ex", "b.1", deadletter.Expired, 1},
+		{"orders", "orders.created", deadletter.Rejected, 1},
+	}
+	if len(messages) != len(tests) {
+		t.Fatalf("inspected %d messages, want %d", len(messages), len(tests))
+	}
+	for i, tt := range tests {
+		m := messages[i]
+		if m.Exchange != tt.exchange || m.RoutingKey != tt.key || m.Reason != tt.reason {
+			t.Errorf("message %d from %s %s %s, want %s %s %s", i, m.Exchange, m.RoutingKey, m.Reason, tt.exchange, tt.key, tt.reason)
+		}
+		if len(m.Deaths) != 1 || m.Deaths[0].Queue != "q" || m.Deaths[0].Count != tt.count || m.Deaths[0].Time.IsZero() {
+			t.Errorf("message %d deaths %+v, want one from q counted %d", i, m.Deaths, tt.count)
+		}
+	}
+
+	// the queue is left as it was
+	if q, _ := b.Queue("dlq"); q.Ready != len(tests) || q.Unacked != 0 {
+		t.Fatalf("dead-letter queue %+v after inspecting, want %d ready", q, len(tests))
+	}
+	again, err := c.Inspect(context.Background(), "dlq", 2)
+	must(t, err)
+	if len(again) != 2 || again[0].RoutingKey != "c.1" || again[1].RoutingKey != "a.1" {
+		t.Fatalf("inspected %+v, want c.1 & a.1 still at the front", again)
+	}
+	if q, _ := b.Queue("dlq"); q.Ready != len(tests) || q.Unacked != 0 {
+		t.Fatalf("dead-letter queue %+v after inspecting, want %d ready", q, len(tests))
+	}
+
+	if _, err := c.Inspect(context.Background(), "", 0); err != deadletter.ERRQUEUEREQUIRED {
+		t.Fatalf("got %v, want queue required", err)
+	}
+}
+
+func TestPreview(t *testing.T) {
+	m := deadletter.Message{Body: []byte("a message body")}
+	tests := map[int]string{
+		-1: "a message body",
+		0:  "...",
+		9:  "a message...",
+		14: "a message body",
+		20: "a message body",
+	}
+	for n, want := range tests {
+		if got := m.Preview(n); got != want {
+			t.Errorf("preview %d got %q, want %q", n, got, want)
+		}
+	}
+}
+
+func TestDeaths(t *testing.T) {
+	at := time.Now().Truncate(time.Second)
+	d := amqp.Delivery{Headers: amqp.Table{"x-death": []interface{}{
+		amqp.Table{"queue": "q.retry.100", "reason": "expired", "count": int32(3), "time": at, "exchange": "", "routing-keys": []interface{}{"q.retry.100"}},
+		"not a table",
+		amqp.Table{"queue": "q", "reason": "rejected", "count": int64(1), "exchange": "ex", "routing-keys": []interface{}{"a.1", "a.2"}},
+	}}}
+
+	deaths := deadletter.Deaths(d)
+	if len(deaths) != 2 {
+		t.Fatalf("decoded %d deaths, want 2", len(deaths))
+	}
+	if got := deaths[0]; got.Queue != "q.retry.100" || got.Reason != deadletter.Expired || got.Count != 3 || !got.Time.Equal(at) {
+		t.Errorf("got %+v, want the expiry from the retry queue", got)
+	}
+	if got := deaths[1]; got.Exchange != "ex" || len(got.RoutingKeys) != 2 || got.RoutingKeys[1] != "a.2" {
+		t.Errorf("got %+v, want the rejection from q", got)
+	}
+	if r := deadletter.Reason(d); r != deadletter.Expired {
+		t.Errorf("reason %s, want the most recent", r)
+	}
+	if ex, key, ok := deadletter.Origin(d); !ok || ex != "" || key != "q.retry.100" {
+		t.Errorf("origin %q %s %t, want the most recent death's", ex, key, ok)
+	}
+
+	if _, _, ok := deadletter.Origin(amqp.Delivery{}); ok {
+		t.Error("origin found without x-death")
+	}
+	if n := len(deadletter.Deaths(amqp.Delivery{})); n != 0 {
+		t.Errorf("%d deaths without x-death", n)
+	}
+}
@@ -0,0 +1,184 @@
+package deadletter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/streadway/amqp"
+	"github.com/theflyingcodr/rabbitmq/consumer"
+)
+
+var (
+	ERRQUEUEREQUIRED = errors.New("queue name is required")
+	ERRNACKED        = errors.New("replayed message was nacked by the broker")
+)
+
+// Channel contains the methods used to read and republish
+// dead-lettered messages, *amqp.Channel and consumer.Channel
+// satisfy it
+type Channel interface {
+	QueueDeclarePassive(name string, durable, autoDelete, exclusive, noWait bool, args amqp.Table) (amqp.Queue, error)
+	Get(queue string, autoAck bool) (amqp.Delivery, bool, error)
+	Publish(exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error
+	Confirm(noWait bool) error
+	NotifyPublish(chan amqp.Confirmation) chan amqp.Confirmation
+}
+
+// Filter selects the messages to replay, empty
+// fields match every message
+type Filter struct {
+	// RoutingKey is a topic pattern matched
+	// against the message's original routing key
+	RoutingKey string
+	// Headers must all be present with the
+	// same value when formatted as a string
+	Headers map[string]string
+	// Reason is matched against why the message was
+	// most recently dead-lettered, ie Rejected or Expired
+	Reason string
+}
+
+// Match returns true if d is selected by the filter
+func (f Filter) Match(d amqp.Delivery) bool {
+	if f.RoutingKey != "" {
+		_, key, ok := Origin(d)
+		if !ok || !consumer.MatchTopic(f.RoutingKey, key) {
+			return false
+		}
+	}
+	if f.Reason != "" && Reason(d) != f.Reason {
+		return false
+	}
+	for k, v := range f.Headers {
+		h, ok := d.Headers[k]
+		if !ok || fmt.Sprint(h) != v {
+			return false
+		}
+	}
+	return true
+}
+
+// Client reads and replays messages from deadletter queues
+type Client struct {
+	ch       Channel
+	confirms chan amqp.Confirmation
+}
+
+// NewClient returns a client using ch, the channel is put
+// into confirm mode the first time messages are replayed
+func NewClient(ch Channel) *Client {
+	return &Client{ch: ch}
+}
+
+// Replay republishes messages in the queue matching the filter to the
+// exchange and routing key they were originally published with, returning
+// how many were replayed. Each message is acked once the broker confirms
+// the republish so nothing is lost if replay stops part way through.
+//
+// Only the messages in the queue when Replay is called are examined and
+// at most limit are replayed, a limit of 0 replays every match. Messages
+// not matching the filter, or without a recorded origin, are left in the queue.
+// The retry attempt header is removed so replayed messages get their
+// full retries again
+func (c *Client) Replay(ctx context.Context, queue string, f Filter, limit int) (int, error) {
+	if queue == "" {
+		return 0, ERRQUEUEREQUIRED
+	}
+	q, err := c.ch.QueueDeclarePassive(queue, false, false, false, false, nil)
+	if err != nil {
+		return 0, err
+	}
+	if c.confirms == nil {
+		if err := c.ch.Confirm(false); err != nil {
+			return 0, err
+		}
+		c.confirms = c.ch.NotifyPublish(make(chan amqp.Confirmation, 1))
+	}
+
+	skipped := make([]amqp.Delivery, 0)
+	defer func() {
+		// requeue in reverse so skipped messages keep their order
+		for i := len(skipped) - 1; i >= 0; i-- {
+			skipped[i].Nack(false, true)
+		}
+	}()
+
+	replayed := 0
+	for i := 0; i < q.Messages; i++ {
+		if limit > 0 && replayed >= limit {
+			break
+		}
+		if err := ctx.Err(); err != nil {
+			return replayed, err
+		}
+		d, ok, err := c.ch.Get(queue, false)
+		if err != nil {
+			return replayed, err
+		}
+		if !ok {
+			break
+		}
+		ex, key, ok := Origin(d)
+		if !ok || !f.Match(d) {
+			skipped = append(skipped, d)
+			continue
+		}
+		if err := c.republish(ctx, ex, key, d); err != nil {
+			d.Nack(false, true)
+			return replayed, err
+		}
+		if err := d.Ack(false); err != nil {
+			return replayed, err
+		}
+		log.Debugf("replayed message from %s to exchange %s with key %s", queue, ex, key)
+		replayed++
+	}
+	return replayed, nil
+}
+
+// republish publishes d to the exchange and waits for the broker to confirm it
+func (c *Client) republish(ctx context.Context, ex, key string, d amqp.Delivery) error {
+	msg := publishing(d)
+	delete(msg.Headers, consumer.RetryAttemptHeader)
+	if err := c.ch.Publish(ex, key, false, false, msg); err != nil {
+		return err
+	}
+
+	select {
+	case conf, ok := <-c.confirms:
+		if !ok {
+			return amqp.ErrClosed
+		}
+		if !conf.Ack {
+			return ERRNACKED
+		}
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// publishing copies a delivery into a publishing
+func publishing(d amqp.Delivery) amqp.Publishing {
+	headers := amqp.Table{}
+	for k, v := range d.Headers {
+		headers[k] = v
+	}
+	return amqp.Publishing{
+		Headers:         headers,
+		ContentType:     d.ContentType,
+		ContentEncoding: d.ContentEncoding,
+		DeliveryMode:    d.DeliveryMode,
+		Priority:        d.Priority,
+		CorrelationId:   d.CorrelationId,
+		ReplyTo:         d.ReplyTo,
+		MessageId:       d.MessageId,
+		Timestamp:       d.Timestamp,
+		Type:            d.Type,
+		UserId:          d.UserId,
+		AppId:           d.AppId,
+		Body:            d.Body,
+	}
+}
@@ -0,0 +1,98 @@
+package deadletter_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/streadway/amqp"
+	"github.com/theflyingcodr/rabbitmq/deadletter"
+	"github.com/theflyingcodr/rabbitmq/memory"
+)
+
+func TestReplay(t *testing.T) {
+	b := memory.NewBroker()
+	conn, _ := b.Dial("mem")
+	ch, _ := conn.Channel()
+	must(t, ch.ExchangeDeclare("ex", "topic", true, false, false, false, nil))
+	must(t, ch.ExchangeDeclare("dlx", "topic", true, false, false, false, nil))
+	_, err := ch.QueueDeclare("q", true, false, false, false, amqp.Table{"x-dead-letter-exchange": "dlx"})
+	must(t, err)
+	_, err = ch.QueueDeclare("dlq", true, false, false, false, nil)
+	must(t, err)
+	must(t, ch.QueueBind("q", "#", "ex", false, nil))
+	must(t, ch.QueueBind("dlq", "#", "dlx", false, nil))
+	for _, k := range []string{"a.1", "b.1", "a.2", "a.3"} {
+		tenant := "x"
+		if k == "a.2" {
+			tenant = "y"
+		}
+		must(t, ch.Publish("ex", k, false, false, amqp.Publishing{Body: []byte(k), Headers: amqp.Table{"tenant": tenant}}))
+	}
+	for i := 0; i < 4; i++ {
+		d, ok, err := ch.Get("q", false)
+		if !ok || err != nil {
+			t.Fatal(ok, err)
+		}
+		must(t, d.Nack(false, false))
+	}
+
+	replay, _ := conn.Channel()
+	f := deadletter.Filter{RoutingKey: "a.*", Reason: "rejected", Headers: map[string]string{"tenant": "x"}}
+	n, err := deadletter.NewClient(replay).Replay(context.Background(), "dlq", f, 0)
+	must(t, err)
+	if n != 2 {
+		t.Fatalf("replayed %d messages, want 2", n)
+	}
+
+	var replayed []string
+	for {
+		d, ok, err := ch.Get("q", true)
+		must(t, err)
+		if !ok {
+			break
+		}
+		if len(deadletter.Deaths(d)) != 1 {
+			t.Fatalf("deaths %v, want the history kept", deadletter.Deaths(d))
+		}
+		replayed = append(replayed, d.RoutingKey)
+	}
+	if len(replayed) != 2 || replayed[0] != "a.1" || replayed[1] != "a.3" {
+		t.Fatalf("replayed %v, want a.1 & a.3 to their original key", replayed)
+	}
+	if q, _ := b.Queue("dlq"); q.Ready != 2 || q.Unacked != 0 {
+		t.Fatalf("dead-letter queue %+v, want the others left", q)
+	}
+}
+
+func TestReplayLimit(t *testing.T) {
+	b := memory.NewBroker()
+	conn, _ := b.Dial("mem")
+	ch, _ := conn.Channel()
+	_, err := ch.QueueDeclare("q", true, false, false, false, amqp.Table{"x-dead-letter-exchange": "", "x-dead-letter-routing-key": "dlq"})
+	must(t, err)
+	_, err = ch.QueueDeclare("dlq", true, false, false, false, nil)
+	must(t, err)
+	for i := 0; i < 3; i++ {
+		must(t, ch.Publish("", "q", false, false, amqp.Publishing{Body: []byte("m")}))
+		d, _, err := ch.Get("q", false)
+		must(t, err)
+		must(t, d.Nack(false, false))
+	}
+
+	replay, _ := conn.Channel()
+	n, err := deadletter.NewClient(replay).Replay(context.Background(), "dlq", deadletter.Filter{}, 1)
+	must(t, err)
+	if n != 1 {
+		t.Fatalf("replayed %d messages, want 1", n)
+	}
+	if q, _ := b.Queue("dlq"); q.Ready != 2 {
+		t.Fatalf("dead-letter queue %+v, want 2 left", q)
+	}
+}
+
+func must(t *testing.T, err error) {
+	t.Helper()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
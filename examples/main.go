@@ -28,7 +28,9 @@ func main(){
 
 	// run the consumer, it will exit on a setup error
 	// or on a graceful shutdown ie ctrl+c
-	if err := host.Run(context.Background()); err != nil{
+	ctx, stop := consumer.WithSignalHandling(context.Background())
+	defer stop()
+	if err := host.Run(ctx); err != nil{
 		logrus.Error(err)
 	}
 }
@@ -0,0 +1,441 @@
+package memory
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/streadway/amqp"
+	"github.com/theflyingcodr/rabbitmq/consumer"
+)
+
+var (
+	ERRBROKERDOWN = errors.New("dial tcp: connection refused, broker is down")
+)
+
+// Broker is an in memory stand in for a RabbitMq broker, it
+// can be used to run a consumer.Host and publishers in unit tests
+// without needing a running server.
+//
+// Exchanges route messages to bound queues, queues deliver
+// to consumers honouring Qos and acks, nacks and rejects behave
+// as they would on RabbitMq including dead-lettering to the exchange
+// named in x-dead-letter-exchange. Messages expire using the queue's
+// x-message-ttl or their own expiration
+//
+//	b := memory.NewBroker()
+//	host := consumer.NewConsumerHost(&consumer.HostConfig{Address:"memory://", Dial:b.Dial})
+//
+// Disconnect and SetDown can be used to exercise the
+// host's reconnect logic
+type Broker struct {
+	mu        *sync.Mutex
+	exchanges map[string]*exchange
+	queues    map[string]*queue
+	conns     map[*Connection]struct{}
+	down      bool
+	seq       int
+}
+
+// QueueState is a snapshot of a queue held by the broker
+type QueueState struct {
+	Name      string
+	Ready     int
+	Unacked   int
+	Consumers int
+}
+
+type exchange struct {
+	name       string
+	kind       string
+	durable    bool
+	autoDelete bool
+	internal   bool
+	args       amqp.Table
+	bindings   []*binding
+}
+
+// binding routes from an exchange to either a queue
+// or, for exchange to exchange bindings, an exchange
+type binding struct {
+	queue    string
+	exchange string
+	key      string
+	args     amqp.Table
+}
+
+type queue struct {
+	name       string
+	durable    bool
+	autoDelete bool
+	exclusive  bool
+	owner      *Connection
+	args       amqp.Table
+	ready      []*message
+	unacked    int
+	consumers  []*consumerState
+	next       int
+}
+
+type message struct {
+	exchange    string
+	routingKey  string
+	msg         amqp.Publishing
+	redelivered bool
+}
+
+// NewBroker returns an empty broker with just the
+// default exchange setup
+func NewBroker() *Broker {
+	b := &Broker{
+		mu:        &sync.Mutex{},
+		exchanges: make(map[string]*exchange),
+		queues:    make(map[string]*queue),
+		conns:     make(map[*Connection]struct{}),
+	}
+	b.exchanges[""] = &exchange{name: "", kind: amqp.ExchangeDirect, durable: true}
+	return b
+}
+
+// Dial opens a new connection to the broker, it satisfies
+// consumer.Dialer so can be set as HostConfig.Dial
+func (b *Broker) Dial(address string) (consumer.Connection, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.down {
+		return nil, ERRBROKERDOWN
+	}
+	conn := &Connection{broker: b, channels: make(map[*Channel]struct{})}
+	b.conns[conn] = struct{}{}
+	return conn, nil
+}
+
+// SetDown marks the broker as down, while down all open
+// connections are dropped and new dials fail
+func (b *Broker) SetDown(down bool) {
+	b.mu.Lock()
+	b.down = down
+	b.mu.Unlock()
+
+	if down {
+		b.Disconnect()
+	}
+}
+
+// Disconnect forcibly closes every open connection as
+// RabbitMq would when it is restarted
+func (b *Broker) Disconnect() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for conn := range b.conns {
+		conn.shutdown(&amqp.Error{
+			Code:    amqp.ConnectionForced,
+			Reason:  "CONNECTION_FORCED - broker forced connection closure with reason 'shutdown'",
+			Server:  true,
+			Recover: true,
+		})
+	}
+}
+
+// Queue returns the state of the named queue, false
+// is returned if the queue hasn't been declared
+func (b *Broker) Queue(name string) (QueueState, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	q, ok := b.queues[name]
+	if !ok {
+		return QueueState{}, false
+	}
+	return QueueState{
+		Name:      q.name,
+		Ready:     len(q.ready),
+		Unacked:   q.unacked,
+		Consumers: len(q.consumers),
+	}, true
+}
+
+// Exchanges returns the names of all declared exchanges
+// excluding the default exchange
+func (b *Broker) Exchanges() []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	names := make([]string, 0, len(b.exchanges))
+	for n := range b.exchanges {
+		if n != "" {
+			names = append(names, n)
+		}
+	}
+	return names
+}
+
+// route delivers a message published to the named exchange to
+// every queue it is bound to returning how many it reached, an error
+// is returned if the exchange doesn't exist. The caller must hold the lock
+func (b *Broker) route(exName, key string, msg amqp.Publishing) (int, *amqp.Error) {
+	ex, ok := b.exchanges[exName]
+	if !ok {
+		return 0, &amqp.Error{
+			Server: true,
+			Code:   amqp.NotFound,
+			Reason: fmt.Sprintf("NOT_FOUND - no exchange '%s' in vhost '/'", exName),
+		}
+	}
+
+	routed := 0
+	for _, name := range b.destinations(ex, key, msg.Headers, make(map[string]bool)) {
+		q, ok := b.queues[name]
+		if !ok {
+			continue
+		}
+		b.enqueue(q, &message{
+			exchange:   exName,
+			routingKey: key,
+			msg:        copyPublishing(msg),
+		})
+		routed++
+	}
+	return routed, nil
+}
+
+// destinations returns the queues a message is routed to from ex,
+// following exchange to exchange bindings and the alternate exchange
+// if nothing else matches. visited stops routing loops, a message
+// reaches each exchange once. The caller must hold the lock
+func (b *Broker) destinations(ex *exchange, key string, headers amqp.Table, visited map[string]bool) []string {
+	if visited[ex.name] {
+		return nil
+	}
+	visited[ex.name] = true
+
+	queues, exchanges := ex.route(key, headers)
+	for _, name := range exchanges {
+		if dest, ok := b.exchanges[name]; ok {
+			queues = append(queues, b.destinations(dest, key, headers, visited)...)
+		}
+	}
+	if len(queues) == 0 {
+		if ae, ok := ex.args["alternate-exchange"].(string); ok {
+			if dest, ok := b.exchanges[ae]; ok {
+				queues = b.destinations(dest, key, headers, visited)
+			}
+		}
+	}
+
+	seen := make(map[string]bool)
+	unique := queues[:0]
+	for _, q := range queues {
+		if !seen[q] {
+			seen[q] = true
+			unique = append(unique, q)
+		}
+	}
+	return unique
+}
+
+// enqueue adds m to the back of q and delivers it if a
+// consumer has capacity. The caller must hold the lock
+func (b *Broker) enqueue(q *queue, m *message) {
+	q.ready = append(q.ready, m)
+	if ttl, ok := m.ttl(q); ok {
+		time.AfterFunc(ttl, func() {
+			b.mu.Lock()
+			defer b.mu.Unlock()
+			b.expire(q, m)
+		})
+	}
+	b.dispatch(q)
+}
+
+// expire dead-letters m if it is still waiting in q
+// The caller must hold the lock
+func (b *Broker) expire(q *queue, m *message) {
+	if b.queues[q.name] != q {
+		return
+	}
+	for i, r := range q.ready {
+		if r == m {
+			q.ready = append(q.ready[:i], q.ready[i+1:]...)
+			b.deadLetter(q, m, "expired")
+			return
+		}
+	}
+}
+
+// requeue puts m back at the front of q
+// The caller must hold the lock
+func (b *Broker) requeue(q *queue, m *message) {
+	m.redelivered = true
+	q.ready = append([]*message{m}, q.ready...)
+	b.dispatch(q)
+}
+
+// dispatch hands ready messages to consumers round robin while
+// they have capacity under their channel's prefetch count.
+// The caller must hold the lock
+func (b *Broker) dispatch(q *queue) {
+	for len(q.ready) > 0 {
+		c := q.nextConsumer()
+		if c == nil {
+			return
+		}
+		m := q.ready[0]
+		q.ready = q.ready[1:]
+		c.deliver(q, m)
+	}
+}
+
+// deadLetter republishes m to the queue's dead letter exchange
+// recording why it died in the x-death header, if the queue has no
+// dead letter exchange the message is dropped. The caller must hold the lock
+func (b *Broker) deadLetter(q *queue, m *message, reason string) {
+	dlx, ok := q.args["x-dead-letter-exchange"].(string)
+	if !ok {
+		return
+	}
+	key := m.routingKey
+	if k, ok := q.args["x-dead-letter-routing-key"].(string); ok {
+		key = k
+	}
+
+	msg := copyPublishing(m.msg)
+	msg.Expiration = ""
+	msg.Headers = addDeath(msg.Headers, q.name, reason, m.exchange, m.routingKey)
+	if _, err := b.route(dlx, key, msg); err != nil {
+		// RabbitMq silently drops messages dead-lettered
+		// to an exchange that doesn't exist
+		return
+	}
+}
+
+// deleteQueue removes q and its bindings, consumers are cancelled
+// and notified as they would be by RabbitMq. The caller must hold the lock
+func (b *Broker) deleteQueue(q *queue) {
+	delete(b.queues, q.name)
+	for _, ex := range b.exchanges {
+		bindings := ex.bindings[:0]
+		for _, bd := range ex.bindings {
+			if bd.queue != q.name {
+				bindings = append(bindings, bd)
+			}
+		}
+		ex.bindings = bindings
+	}
+	consumers := q.consumers
+	q.consumers = nil
+	for _, c := range consumers {
+		c.ch.cancelConsumer(c, true, false)
+	}
+}
+
+// nextConsumer returns the next consumer in round robin order
+// which has capacity for another message
+func (q *queue) nextConsumer() *consumerState {
+	for i := 0; i < len(q.consumers); i++ {
+		c := q.consumers[(q.next+i)%len(q.consumers)]
+		if c.hasCapacity() {
+			q.next = (q.next + i + 1) % len(q.consumers)
+			return c
+		}
+	}
+	return nil
+}
+
+// route returns the names of the queues and exchanges
+// bound with a binding that matches the routing key
+func (e *exchange) route(key string, headers amqp.Table) ([]string, []string) {
+	if e.name == "" {
+		// the default exchange routes directly to the queue named by the key
+		return []string{key}, nil
+	}
+
+	queues := make([]string, 0)
+	exchanges := make([]string, 0)
+	for _, bd := range e.bindings {
+		if !Match(e.kind, bd.key, bd.args, key, headers) {
+			continue
+		}
+		if bd.exchange != "" {
+			exchanges = append(exchanges, bd.exchange)
+			continue
+		}
+		queues = append(queues, bd.queue)
+	}
+	return queues, exchanges
+}
+
+// addDeath records a death in the x-death header in the same way
+// RabbitMq does, the most recent death is first and repeated deaths
+// from the same queue for the same reason increment its count
+func addDeath(headers amqp.Table, queueName, reason, exName, key string) amqp.Table {
+	h := amqp.Table{}
+	for k, v := range headers {
+		h[k] = v
+	}
+
+	deaths, _ := h["x-death"].([]interface{})
+	updated := make([]interface{}, 0, len(deaths)+1)
+	var death amqp.Table
+	for _, d := range deaths {
+		t, ok := d.(amqp.Table)
+		if ok && death == nil && t["queue"] == queueName && t["reason"] == reason {
+			death = t
+			continue
+		}
+		updated = append(updated, d)
+	}
+
+	if death == nil {
+		death = amqp.Table{
+			"count":        int64(0),
+			"reason":       reason,
+			"queue":        queueName,
+			"exchange":     exName,
+			"routing-keys": []interface{}{key},
+		}
+	}
+	count, _ := death["count"].(int64)
+	death["count"] = count + 1
+	death["time"] = time.Now().Truncate(time.Second)
+	h["x-death"] = append([]interface{}{death}, updated...)
+
+	if _, ok := h["x-first-death-reason"]; !ok {
+		h["x-first-death-reason"] = reason
+		h["x-first-death-queue"] = queueName
+		h["x-first-death-exchange"] = exName
+	}
+	return h
+}
+
+// ttl returns how long m can wait in q before expiring, the
+// lower of the queue's x-message-ttl and the message expiration
+func (m *message) ttl(q *queue) (time.Duration, bool) {
+	ttl := time.Duration(-1)
+	if v, ok := normalise(q.args["x-message-ttl"]).(int64); ok {
+		ttl = time.Duration(v) * time.Millisecond
+	}
+	if m.msg.Expiration != "" {
+		if v, err := strconv.ParseInt(m.msg.Expiration, 10, 64); err == nil {
+			if e := time.Duration(v) * time.Millisecond; ttl < 0 || e < ttl {
+				ttl = e
+			}
+		}
+	}
+	return ttl, ttl >= 0
+}
+
+func copyPublishing(msg amqp.Publishing) amqp.Publishing {
+	if msg.Headers != nil {
+		h := amqp.Table{}
+		for k, v := range msg.Headers {
+			h[k] = v
+		}
+		msg.Headers = h
+	}
+	return msg
+}
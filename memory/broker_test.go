@@ -0,0 +1,213 @@
+package memory_test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/streadway/amqp"
+	"github.com/theflyingcodr/rabbitmq/consumer"
+	"github.com/theflyingcodr/rabbitmq/memory"
+)
+
+func channel(t *testing.T, b *memory.Broker) consumer.Channel {
+	t.Helper()
+	conn, err := b.Dial("mem")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	ch, err := conn.Channel()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ch
+}
+
+func must(t *testing.T, err error) {
+	t.Helper()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func ready(t *testing.T, b *memory.Broker, queue string) int {
+	t.Helper()
+	q, ok := b.Queue(queue)
+	if !ok {
+		t.Fatalf("queue %s wasn't declared", queue)
+	}
+	return q.Ready
+}
+
+func TestRouting(t *testing.T) {
+	tests := map[string]struct {
+		kind    string
+		key     string
+		args    amqp.Table
+		publish string
+		headers amqp.Table
+		want    int
+	}{
+		"direct match":       {consumer.DIRECT_EXCHANGE, "a.b", nil, "a.b", nil, 1},
+		"direct miss":        {consumer.DIRECT_EXCHANGE, "a.b", nil, "a.c", nil, 0},
+		"topic match":        {consumer.TOPIC_EXCHANGE, "a.#", nil, "a.b.c", nil, 1},
+		"topic miss":         {consumer.TOPIC_EXCHANGE, "a.*", nil, "a.b.c", nil, 0},
+		"fanout":             {consumer.FANOUT_EXCHANGE, "ignored", nil, "anything", nil, 1},
+		"headers all":        {consumer.HEADERS_EXCHANGE, "", amqp.Table{"x-match": "all", "r": "eu", "t": "gold"}, "", amqp.Table{"r": "eu", "t": "gold"}, 1},
+		"headers all missed": {consumer.HEADERS_EXCHANGE, "", amqp.Table{"x-match": "all", "r": "eu", "t": "gold"}, "", amqp.Table{"r": "eu"}, 0},
+		"headers any":        {consumer.HEADERS_EXCHANGE, "", amqp.Table{"x-match": "any", "r": "eu", "t": "gold"}, "", amqp.Table{"r": "eu"}, 1},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			b := memory.NewBroker()
+			ch := channel(t, b)
+			must(t, ch.ExchangeDeclare("ex", tt.kind, true, false, false, false, nil))
+			_, err := ch.QueueDeclare("q", true, false, false, false, nil)
+			must(t, err)
+			must(t, ch.QueueBind("q", tt.key, "ex", false, tt.args))
+			must(t, ch.Publish("ex", tt.publish, false, false, amqp.Publishing{Headers: tt.headers}))
+			if n := ready(t, b, "q"); n != tt.want {
+				t.Fatalf("%d messages routed, want %d", n, tt.want)
+			}
+		})
+	}
+}
+
+func TestExchangeToExchangeBinding(t *testing.T) {
+	b := memory.NewBroker()
+	ch := channel(t, b)
+	must(t, ch.ExchangeDeclare("source", consumer.TOPIC_EXCHANGE, true, false, false, false, nil))
+	must(t, ch.ExchangeDeclare("dest", consumer.FANOUT_EXCHANGE, true, false, false, false, nil))
+	must(t, ch.ExchangeBind("dest", "orders.*", "source", false, nil))
+	_, err := ch.QueueDeclare("q", true, false, false, false, nil)
+	must(t, err)
+	must(t, ch.QueueBind("q", "", "dest", false, nil))
+
+	must(t, ch.Publish("source", "orders.created", false, false, amqp.Publishing{}))
+	must(t, ch.Publish("source", "users.created", false, false, amqp.Publishing{}))
+	if n := ready(t, b, "q"); n != 1 {
+		t.Fatalf("%d messages routed, want 1", n)
+	}
+}
+
+func TestDeadLetter(t *testing.T) {
+	b := memory.NewBroker()
+	ch := channel(t, b)
+	must(t, ch.ExchangeDeclare("dlx", consumer.TOPIC_EXCHANGE, true, false, false, false, nil))
+	_, err := ch.QueueDeclare("dlq", true, false, false, false, nil)
+	must(t, err)
+	must(t, ch.QueueBind("dlq", "#", "dlx", false, nil))
+	_, err = ch.QueueDeclare("q", true, false, false, false, amqp.Table{
+		"x-dead-letter-exchange": "dlx",
+		"x-message-ttl":          int32(20),
+	})
+	must(t, err)
+
+	// one is rejected, the other expires
+	must(t, ch.Publish("", "q", false, false, amqp.Publishing{Body: []byte("rejected")}))
+	d, ok, err := ch.Get("q", false)
+	if err != nil || !ok {
+		t.Fatalf("get %v %v", ok, err)
+	}
+	must(t, d.Nack(false, false))
+	must(t, ch.Publish("", "q", false, false, amqp.Publishing{Body: []byte("expired")}))
+
+	for _, want := range []string{"rejected", "expired"} {
+		var d amqp.Delivery
+		for deadline := time.Now().Add(time.Second); ; time.Sleep(5 * time.Millisecond) {
+			if d, ok, err = ch.Get("dlq", true); err != nil || ok {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("%s message wasn't dead-lettered", want)
+			}
+		}
+		must(t, err)
+		deaths, _ := d.Headers["x-death"].([]interface{})
+		if string(d.Body) != want || len(deaths) != 1 {
+			t.Fatalf("got %s with deaths %v, want %s", d.Body, deaths, want)
+		}
+		if reason := deaths[0].(amqp.Table)["reason"]; reason != want {
+			t.Fatalf("death reason %s, want %s", reason, want)
+		}
+	}
+}
+
+func TestRedeclareConflict(t *testing.T) {
+	b := memory.NewBroker()
+	ch := channel(t, b)
+	_, err := ch.QueueDeclare("q", true, false, false, false, amqp.Table{"x-message-ttl": int32(1000)})
+	must(t, err)
+	// integer types are equivalent, as they are to RabbitMq
+	_, err = ch.QueueDeclare("q", true, false, false, false, amqp.Table{"x-message-ttl": int64(1000)})
+	must(t, err)
+
+	_, err = ch.QueueDeclare("q", true, false, false, false, amqp.Table{"x-message-ttl": int32(5000)})
+	var e *amqp.Error
+	if !errors.As(err, &e) || e.Code != amqp.PreconditionFailed {
+		t.Fatalf("got %v, want PRECONDITION_FAILED", err)
+	}
+	if _, err := ch.QueueDeclarePassive("q", true, false, false, false, nil); err != amqp.ErrClosed {
+		t.Fatalf("got %v, want the channel closed", err)
+	}
+}
+
+func TestExclusiveQueue(t *testing.T) {
+	b := memory.NewBroker()
+	owner := channel(t, b)
+	_, err := owner.QueueDeclare("q", false, false, true, false, nil)
+	must(t, err)
+
+	_, err = channel(t, b).QueueDeclarePassive("q", false, false, true, false, nil)
+	var e *amqp.Error
+	if !errors.As(err, &e) || e.Code != amqp.ResourceLocked {
+		t.Fatalf("got %v, want RESOURCE_LOCKED", err)
+	}
+}
+
+func TestDisconnect(t *testing.T) {
+	b := memory.NewBroker()
+	conn, err := b.Dial("mem")
+	must(t, err)
+	closed := conn.NotifyClose(make(chan *amqp.Error, 1))
+
+	b.SetDown(true)
+	if err := <-closed; err == nil || err.Code != amqp.ConnectionForced {
+		t.Fatalf("got %v, want CONNECTION_FORCED", err)
+	}
+	if _, err := b.Dial("mem"); !errors.Is(err, memory.ERRBROKERDOWN) {
+		t.Fatalf("got %v, want broker down", err)
+	}
+	b.SetDown(false)
+	if _, err := b.Dial("mem"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMandatoryReturn(t *testing.T) {
+	b := memory.NewBroker()
+	ch := channel(t, b)
+	must(t, ch.ExchangeDeclare("ex", consumer.TOPIC_EXCHANGE, true, false, false, false, nil))
+	must(t, ch.Confirm(false))
+	returns := ch.NotifyReturn(make(chan amqp.Return, 1))
+	confirms := ch.NotifyPublish(make(chan amqp.Confirmation, 1))
+
+	must(t, ch.Publish("ex", "nowhere", true, false, amqp.Publishing{Body: []byte("m")}))
+	r := <-returns
+	if r.ReplyCode != amqp.NoRoute || r.RoutingKey != "nowhere" || string(r.Body) != "m" {
+		t.Fatalf("got return %+v", r)
+	}
+	// RabbitMq acks unroutable messages after returning them
+	if c := <-confirms; !c.Ack {
+		t.Fatal("unroutable message was nacked")
+	}
+
+	must(t, ch.Publish("ex", "nowhere", false, false, amqp.Publishing{}))
+	<-confirms
+	select {
+	case r := <-returns:
+		t.Fatalf("returned %+v which wasn't mandatory", r)
+	default:
+	}
+}
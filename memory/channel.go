@@ -0,0 +1,1110 @@
+package memory
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"sync"
+
+	"github.com/streadway/amqp"
+	"github.com/theflyingcodr/rabbitmq/consumer"
+)
+
+// Connection is a connection to a Broker, it
+// implements consumer.Connection
+type Connection struct {
+	broker         *Broker
+	channels       map[*Channel]struct{}
+	closed         bool
+	closeListeners []chan *amqp.Error
+}
+
+// Channel is a channel opened on a Connection, it implements
+// consumer.Channel and is the amqp.Acknowledger for the deliveries
+// it sends to consumers
+type Channel struct {
+	conn            *Connection
+	closed          bool
+	prefetch        int
+	tag             uint64
+	unacked         map[uint64]*unackedDelivery
+	consumers       map[string]*consumerState
+	seq             int
+	confirming      bool
+	publishSeq      uint64
+	closeListeners  []chan *amqp.Error
+	cancelListeners []chan string
+	confirmations   []chan amqp.Confirmation
+	returns         []chan amqp.Return
+	// events are run in order by the notifier so listeners
+	// are never sent to while the broker is locked
+	events []func()
+	wake   chan struct{}
+}
+
+type unackedDelivery struct {
+	queue    *queue
+	message  *message
+	consumer *consumerState
+}
+
+// consumerState is a consumer registered on a queue, deliveries
+// are buffered and sent by pump so a slow consumer never blocks
+// the broker
+type consumerState struct {
+	tag       string
+	ch        *Channel
+	queue     *queue
+	autoAck   bool
+	exclusive bool
+	unacked   int
+	buf       []amqp.Delivery
+	cancelled bool
+	// draining is set when the client cancels the consumer, like
+	// amqp the deliveries already sent are still received before
+	// the delivery channel is closed
+	draining bool
+	wake     chan struct{}
+	out      chan amqp.Delivery
+}
+
+// Channel opens a new channel on the connection
+func (c *Connection) Channel() (consumer.Channel, error) {
+	c.broker.mu.Lock()
+	defer c.broker.mu.Unlock()
+
+	if c.closed {
+		return nil, amqp.ErrClosed
+	}
+	ch := &Channel{
+		conn:      c,
+		unacked:   make(map[uint64]*unackedDelivery),
+		consumers: make(map[string]*consumerState),
+		wake:      make(chan struct{}, 1),
+	}
+	c.channels[ch] = struct{}{}
+	go ch.notifier()
+	return ch, nil
+}
+
+// NotifyClose registers a listener for when the connection closes,
+// the error is sent if the close wasn't requested by the client
+func (c *Connection) NotifyClose(l chan *amqp.Error) chan *amqp.Error {
+	c.broker.mu.Lock()
+	defer c.broker.mu.Unlock()
+
+	if c.closed {
+		close(l)
+		return l
+	}
+	c.closeListeners = append(c.closeListeners, l)
+	return l
+}
+
+// Close closes the connection and all of its channels
+func (c *Connection) Close() error {
+	c.broker.mu.Lock()
+	defer c.broker.mu.Unlock()
+
+	if c.closed {
+		return amqp.ErrClosed
+	}
+	c.shutdown(nil)
+	return nil
+}
+
+// shutdown closes the connection, err is nil when the client
+// closed the connection. The caller must hold the lock
+func (c *Connection) shutdown(err *amqp.Error) {
+	if c.closed {
+		return
+	}
+	c.closed = true
+
+	for ch := range c.channels {
+		ch.shutdown(err)
+	}
+	for _, q := range c.broker.queues {
+		if q.exclusive && q.owner == c {
+			c.broker.deleteQueue(q)
+		}
+	}
+	delete(c.broker.conns, c)
+
+	for _, l := range c.closeListeners {
+		go func(l chan *amqp.Error) {
+			if err != nil {
+				l <- err
+			}
+			close(l)
+		}(l)
+	}
+	c.closeListeners = nil
+}
+
+// Qos sets the number of messages consumers on this
+// channel can have unacknowledged
+func (ch *Channel) Qos(prefetchCount, prefetchSize int, global bool) error {
+	b := ch.conn.broker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if ch.closed {
+		return amqp.ErrClosed
+	}
+	ch.prefetch = prefetchCount
+	for _, c := range ch.consumers {
+		b.dispatch(c.queue)
+	}
+	return nil
+}
+
+// ExchangeDeclare declares an exchange, if it already exists it must
+// have been declared with the same parameters
+func (ch *Channel) ExchangeDeclare(name, kind string, durable, autoDelete, internal, noWait bool, args amqp.Table) error {
+	b := ch.conn.broker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if ch.closed {
+		return amqp.ErrClosed
+	}
+	if name == "" {
+		return ch.closeWith(&amqp.Error{
+			Code:   amqp.AccessRefused,
+			Reason: "ACCESS_REFUSED - operation not permitted on the default exchange",
+		})
+	}
+
+	switch kind {
+	case amqp.ExchangeDirect, amqp.ExchangeFanout, amqp.ExchangeTopic, amqp.ExchangeHeaders:
+	default:
+		// an unknown type is a connection error on RabbitMq
+		err := &amqp.Error{
+			Code:   amqp.CommandInvalid,
+			Reason: fmt.Sprintf("COMMAND_INVALID - invalid exchange type '%s'", kind),
+			Server: true,
+		}
+		ch.conn.shutdown(err)
+		return err
+	}
+
+	if ex, ok := b.exchanges[name]; ok {
+		if err := ex.equivalent(kind, durable, autoDelete, internal, args); err != nil {
+			return ch.closeWith(err)
+		}
+		return nil
+	}
+
+	b.exchanges[name] = &exchange{
+		name:       name,
+		kind:       kind,
+		durable:    durable,
+		autoDelete: autoDelete,
+		internal:   internal,
+		args:       copyTable(args),
+	}
+	return nil
+}
+
+// ExchangeDeclarePassive checks an exchange exists, the
+// channel is closed with a NOT_FOUND error if it doesn't
+func (ch *Channel) ExchangeDeclarePassive(name, kind string, durable, autoDelete, internal, noWait bool, args amqp.Table) error {
+	b := ch.conn.broker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if ch.closed {
+		return amqp.ErrClosed
+	}
+	if _, ok := b.exchanges[name]; !ok {
+		return ch.closeWith(notFound("exchange", name))
+	}
+	return nil
+}
+
+// QueueDeclare declares a queue, if it already exists it must have
+// been declared with the same parameters
+func (ch *Channel) QueueDeclare(name string, durable, autoDelete, exclusive, noWait bool, args amqp.Table) (amqp.Queue, error) {
+	b := ch.conn.broker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if ch.closed {
+		return amqp.Queue{}, amqp.ErrClosed
+	}
+	if name == "" {
+		b.seq++
+		name = fmt.Sprintf("amq.gen-%d", b.seq)
+	}
+
+	if q, ok := b.queues[name]; ok {
+		if err := ch.accessible(q); err != nil {
+			return amqp.Queue{}, ch.closeWith(err)
+		}
+		if err := q.equivalent(durable, autoDelete, exclusive, args); err != nil {
+			return amqp.Queue{}, ch.closeWith(err)
+		}
+		return q.state(), nil
+	}
+
+	q := &queue{
+		name:       name,
+		durable:    durable,
+		autoDelete: autoDelete,
+		exclusive:  exclusive,
+		args:       copyTable(args),
+	}
+	if exclusive {
+		q.owner = ch.conn
+	}
+	b.queues[name] = q
+	return q.state(), nil
+}
+
+// QueueDeclarePassive returns the state of an existing queue,
+// the channel is closed with a NOT_FOUND error if it doesn't exist
+func (ch *Channel) QueueDeclarePassive(name string, durable, autoDelete, exclusive, noWait bool, args amqp.Table) (amqp.Queue, error) {
+	b := ch.conn.broker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if ch.closed {
+		return amqp.Queue{}, amqp.ErrClosed
+	}
+	q, ok := b.queues[name]
+	if !ok {
+		return amqp.Queue{}, ch.closeWith(notFound("queue", name))
+	}
+	if err := ch.accessible(q); err != nil {
+		return amqp.Queue{}, ch.closeWith(err)
+	}
+	return q.state(), nil
+}
+
+// QueueDelete deletes a queue returning the number of messages it
+// held, with ifUnused or ifEmpty set the channel is closed with a
+// PRECONDITION_FAILED error if the queue has consumers or messages
+func (ch *Channel) QueueDelete(name string, ifUnused, ifEmpty, noWait bool) (int, error) {
+	b := ch.conn.broker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if ch.closed {
+		return 0, amqp.ErrClosed
+	}
+	q, ok := b.queues[name]
+	if !ok {
+		return 0, nil
+	}
+	if err := ch.accessible(q); err != nil {
+		return 0, ch.closeWith(err)
+	}
+	if ifUnused && len(q.consumers) > 0 {
+		return 0, ch.closeWith(&amqp.Error{
+			Code:   amqp.PreconditionFailed,
+			Reason: fmt.Sprintf("PRECONDITION_FAILED - queue '%s' in vhost '/' in use", name),
+		})
+	}
+	if ifEmpty && len(q.ready) > 0 {
+		return 0, ch.closeWith(&amqp.Error{
+			Code:   amqp.PreconditionFailed,
+			Reason: fmt.Sprintf("PRECONDITION_FAILED - queue '%s' in vhost '/' is not empty", name),
+		})
+	}
+	n := len(q.ready)
+	b.deleteQueue(q)
+	return n, nil
+}
+
+// QueueBind binds a queue to an exchange with the key provided
+func (ch *Channel) QueueBind(name, key, exName string, noWait bool, args amqp.Table) error {
+	b := ch.conn.broker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if ch.closed {
+		return amqp.ErrClosed
+	}
+	q, ok := b.queues[name]
+	if !ok {
+		return ch.closeWith(notFound("queue", name))
+	}
+	if err := ch.accessible(q); err != nil {
+		return ch.closeWith(err)
+	}
+	ex, ok := b.exchanges[exName]
+	if !ok {
+		return ch.closeWith(notFound("exchange", exName))
+	}
+	if exName == "" {
+		return ch.closeWith(&amqp.Error{
+			Code:   amqp.AccessRefused,
+			Reason: "ACCESS_REFUSED - operation not permitted on the default exchange",
+		})
+	}
+
+	for _, bd := range ex.bindings {
+		if bd.queue == name && bd.key == key && equalTables(bd.args, args) {
+			return nil
+		}
+	}
+	ex.bindings = append(ex.bindings, &binding{queue: name, key: key, args: copyTable(args)})
+	return nil
+}
+
+// ExchangeBind binds the destination exchange to the source so
+// messages matching the key are routed through to it
+func (ch *Channel) ExchangeBind(destination, key, source string, noWait bool, args amqp.Table) error {
+	b := ch.conn.broker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if ch.closed {
+		return amqp.ErrClosed
+	}
+	if destination == "" || source == "" {
+		return ch.closeWith(&amqp.Error{
+			Code:   amqp.AccessRefused,
+			Reason: "ACCESS_REFUSED - operation not permitted on the default exchange",
+		})
+	}
+	if _, ok := b.exchanges[destination]; !ok {
+		return ch.closeWith(notFound("exchange", destination))
+	}
+	ex, ok := b.exchanges[source]
+	if !ok {
+		return ch.closeWith(notFound("exchange", source))
+	}
+
+	for _, bd := range ex.bindings {
+		if bd.exchange == destination && bd.key == key && equalTables(bd.args, args) {
+			return nil
+		}
+	}
+	ex.bindings = append(ex.bindings, &binding{exchange: destination, key: key, args: copyTable(args)})
+	return nil
+}
+
+// Consume starts delivering messages from the queue, the returned
+// channel is closed when the consumer is cancelled or the channel closes
+func (ch *Channel) Consume(queueName, tag string, autoAck, exclusive, noLocal, noWait bool, args amqp.Table) (<-chan amqp.Delivery, error) {
+	b := ch.conn.broker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if ch.closed {
+		return nil, amqp.ErrClosed
+	}
+	q, ok := b.queues[queueName]
+	if !ok {
+		return nil, ch.closeWith(notFound("queue", queueName))
+	}
+	if err := ch.accessible(q); err != nil {
+		return nil, ch.closeWith(err)
+	}
+	if tag == "" {
+		ch.seq++
+		tag = fmt.Sprintf("ctag-memory-%d", ch.seq)
+	}
+	if _, ok := ch.consumers[tag]; ok {
+		return nil, ch.closeWith(&amqp.Error{
+			Code:   amqp.NotAllowed,
+			Reason: fmt.Sprintf("NOT_ALLOWED - attempt to reuse consumer tag '%s'", tag),
+		})
+	}
+	for _, c := range q.consumers {
+		if exclusive || c.exclusive {
+			return nil, ch.closeWith(&amqp.Error{
+				Code:   amqp.AccessRefused,
+				Reason: fmt.Sprintf("ACCESS_REFUSED - queue '%s' in vhost '/' in exclusive use", q.name),
+			})
+		}
+	}
+
+	c := &consumerState{
+		tag:       tag,
+		ch:        ch,
+		queue:     q,
+		autoAck:   autoAck,
+		exclusive: exclusive,
+		wake:      make(chan struct{}, 1),
+		out:       make(chan amqp.Delivery),
+	}
+	ch.consumers[tag] = c
+	q.consumers = append(q.consumers, c)
+	go c.pump(b.mu)
+	b.dispatch(q)
+	return c.out, nil
+}
+
+// Publish routes msg through the exchange, publishing to an exchange
+// that doesn't exist closes the channel as RabbitMq would. Mandatory
+// messages which aren't routed to a queue are sent to NotifyReturn
+func (ch *Channel) Publish(exName, key string, mandatory, immediate bool, msg amqp.Publishing) error {
+	b := ch.conn.broker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if ch.closed {
+		return amqp.ErrClosed
+	}
+	routed, err := b.route(exName, key, msg)
+	if err != nil {
+		ch.shutdown(err)
+		return nil
+	}
+	if mandatory && routed == 0 {
+		// as with amqp the return is sent before the confirm
+		ret := returned(exName, key, msg)
+		listeners := ch.returns
+		ch.notify(func() {
+			for _, l := range listeners {
+				l <- ret
+			}
+		})
+	}
+
+	if ch.confirming {
+		ch.publishSeq++
+		confirm := amqp.Confirmation{DeliveryTag: ch.publishSeq, Ack: true}
+		listeners := ch.confirmations
+		ch.notify(func() {
+			for _, l := range listeners {
+				l <- confirm
+			}
+		})
+	}
+	return nil
+}
+
+// Get takes the message at the head of the queue, false is
+// returned if the queue is empty
+func (ch *Channel) Get(queueName string, autoAck bool) (amqp.Delivery, bool, error) {
+	b := ch.conn.broker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if ch.closed {
+		return amqp.Delivery{}, false, amqp.ErrClosed
+	}
+	q, ok := b.queues[queueName]
+	if !ok {
+		return amqp.Delivery{}, false, ch.closeWith(notFound("queue", queueName))
+	}
+	if err := ch.accessible(q); err != nil {
+		return amqp.Delivery{}, false, ch.closeWith(err)
+	}
+	if len(q.ready) == 0 {
+		return amqp.Delivery{}, false, nil
+	}
+
+	m := q.ready[0]
+	q.ready = q.ready[1:]
+	ch.tag++
+	if !autoAck {
+		ch.unacked[ch.tag] = &unackedDelivery{queue: q, message: m}
+		q.unacked++
+	}
+	d := delivery(ch, m, ch.tag)
+	d.MessageCount = uint32(len(q.ready))
+	return d, true, nil
+}
+
+// Confirm puts the channel into confirm mode, every
+// message published is acked once it has been routed
+func (ch *Channel) Confirm(noWait bool) error {
+	b := ch.conn.broker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if ch.closed {
+		return amqp.ErrClosed
+	}
+	ch.confirming = true
+	return nil
+}
+
+// NotifyPublish registers a listener for publisher confirms
+func (ch *Channel) NotifyPublish(l chan amqp.Confirmation) chan amqp.Confirmation {
+	b := ch.conn.broker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if ch.closed {
+		close(l)
+		return l
+	}
+	ch.confirmations = append(ch.confirmations, l)
+	return l
+}
+
+// NotifyReturn registers a listener for mandatory
+// messages which couldn't be routed to a queue
+func (ch *Channel) NotifyReturn(l chan amqp.Return) chan amqp.Return {
+	b := ch.conn.broker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if ch.closed {
+		close(l)
+		return l
+	}
+	ch.returns = append(ch.returns, l)
+	return l
+}
+
+// NotifyClose registers a listener for when the channel closes,
+// the error is sent if the close wasn't requested by the client
+func (ch *Channel) NotifyClose(l chan *amqp.Error) chan *amqp.Error {
+	b := ch.conn.broker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if ch.closed {
+		close(l)
+		return l
+	}
+	ch.closeListeners = append(ch.closeListeners, l)
+	return l
+}
+
+// NotifyCancel registers a listener which receives the tag of
+// consumers cancelled by the broker, ie when their queue is deleted
+func (ch *Channel) NotifyCancel(l chan string) chan string {
+	b := ch.conn.broker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if ch.closed {
+		close(l)
+		return l
+	}
+	ch.cancelListeners = append(ch.cancelListeners, l)
+	return l
+}
+
+// Cancel stops the consumer with the tag provided, no more messages
+// are sent to it. As with amqp, deliveries already sent are still
+// received before its delivery channel is closed
+func (ch *Channel) Cancel(consumer string, noWait bool) error {
+	b := ch.conn.broker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if ch.closed {
+		return amqp.ErrClosed
+	}
+	if c, ok := ch.consumers[consumer]; ok {
+		ch.cancelConsumer(c, false, true)
+	}
+	return nil
+}
+
+// Close closes the channel, unacknowledged
+// messages are requeued
+func (ch *Channel) Close() error {
+	b := ch.conn.broker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if ch.closed {
+		return amqp.ErrClosed
+	}
+	ch.shutdown(nil)
+	return nil
+}
+
+// Ack acknowledges a delivery, removing it from its queue
+func (ch *Channel) Ack(tag uint64, multiple bool) error {
+	b := ch.conn.broker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	deliveries, err := ch.take(tag, multiple)
+	if err != nil {
+		return err
+	}
+	for _, d := range deliveries {
+		b.dispatch(d.queue)
+	}
+	return nil
+}
+
+// Nack negatively acknowledges a delivery, it is either requeued
+// or dead-lettered if the queue has a dead letter exchange
+func (ch *Channel) Nack(tag uint64, multiple bool, requeue bool) error {
+	b := ch.conn.broker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	deliveries, err := ch.take(tag, multiple)
+	if err != nil {
+		return err
+	}
+	// requeue in reverse so the earliest delivery
+	// ends up at the front of the queue
+	for i := len(deliveries) - 1; i >= 0; i-- {
+		d := deliveries[i]
+		if requeue {
+			b.requeue(d.queue, d.message)
+			continue
+		}
+		b.deadLetter(d.queue, d.message, "rejected")
+		b.dispatch(d.queue)
+	}
+	return nil
+}
+
+// Reject negatively acknowledges a single delivery
+func (ch *Channel) Reject(tag uint64, requeue bool) error {
+	return ch.Nack(tag, false, requeue)
+}
+
+// take removes deliveries from the unacked set, if multiple is true
+// every delivery up to and including tag is removed
+// The caller must hold the lock
+func (ch *Channel) take(tag uint64, multiple bool) ([]*unackedDelivery, error) {
+	if ch.closed {
+		return nil, amqp.ErrClosed
+	}
+
+	tags := make([]uint64, 0)
+	if multiple {
+		for t := range ch.unacked {
+			if t <= tag {
+				tags = append(tags, t)
+			}
+		}
+		sort.Slice(tags, func(i, j int) bool { return tags[i] < tags[j] })
+	} else if _, ok := ch.unacked[tag]; ok {
+		tags = append(tags, tag)
+	}
+	if len(tags) == 0 {
+		return nil, ch.closeWith(&amqp.Error{
+			Code:   amqp.PreconditionFailed,
+			Reason: fmt.Sprintf("PRECONDITION_FAILED - unknown delivery tag %d", tag),
+		})
+	}
+
+	deliveries := make([]*unackedDelivery, 0, len(tags))
+	for _, t := range tags {
+		d := ch.unacked[t]
+		delete(ch.unacked, t)
+		if d.consumer != nil {
+			// deliveries taken with Get have no consumer
+			d.consumer.unacked--
+		}
+		d.queue.unacked--
+		deliveries = append(deliveries, d)
+	}
+	return deliveries, nil
+}
+
+// closeWith closes the channel with a server error
+// and returns it. The caller must hold the lock
+func (ch *Channel) closeWith(err *amqp.Error) error {
+	// the broker closed the channel, as opposed to the client
+	err.Server = true
+	switch err.Code {
+	case amqp.ContentTooLarge, amqp.NoRoute, amqp.NoConsumers,
+		amqp.AccessRefused, amqp.NotFound, amqp.ResourceLocked, amqp.PreconditionFailed:
+		// soft errors only close the channel
+		err.Recover = true
+	}
+	ch.shutdown(err)
+	return err
+}
+
+// shutdown closes the channel cancelling its consumers and requeuing
+// unacked messages, err is nil when the client closed the channel.
+// The caller must hold the lock
+func (ch *Channel) shutdown(err *amqp.Error) {
+	if ch.closed {
+		return
+	}
+	ch.closed = true
+	b := ch.conn.broker
+
+	for _, c := range ch.consumers {
+		ch.cancelConsumer(c, false, false)
+	}
+
+	tags := make([]uint64, 0, len(ch.unacked))
+	for t := range ch.unacked {
+		tags = append(tags, t)
+	}
+	sort.Slice(tags, func(i, j int) bool { return tags[i] > tags[j] })
+	for _, t := range tags {
+		d := ch.unacked[t]
+		delete(ch.unacked, t)
+		d.queue.unacked--
+		if b.queues[d.queue.name] == d.queue {
+			b.requeue(d.queue, d.message)
+		}
+	}
+	delete(ch.conn.channels, ch)
+
+	closes, cancels, confirms, returns := ch.closeListeners, ch.cancelListeners, ch.confirmations, ch.returns
+	ch.closeListeners, ch.cancelListeners, ch.confirmations, ch.returns = nil, nil, nil, nil
+	ch.notify(func() {
+		for _, l := range closes {
+			if err != nil {
+				l <- err
+			}
+			close(l)
+		}
+		for _, l := range cancels {
+			close(l)
+		}
+		for _, l := range confirms {
+			close(l)
+		}
+		for _, l := range returns {
+			close(l)
+		}
+	})
+}
+
+// cancelConsumer removes a consumer from its queue, if drain is set
+// deliveries already sent are still received, otherwise those it
+// hasn't received yet are requeued. The caller must hold the lock
+func (ch *Channel) cancelConsumer(c *consumerState, notify, drain bool) {
+	if c.cancelled || c.draining {
+		return
+	}
+	delete(ch.consumers, c.tag)
+
+	q := c.queue
+	consumers := q.consumers[:0]
+	for _, qc := range q.consumers {
+		if qc != c {
+			consumers = append(consumers, qc)
+		}
+	}
+	q.consumers = consumers
+
+	b := ch.conn.broker
+	if drain {
+		// they're acked by the client or requeued when the channel closes
+		c.draining = true
+	} else {
+		c.cancelled = true
+		for i := len(c.buf) - 1; i >= 0; i-- {
+			d, ok := ch.unacked[c.buf[i].DeliveryTag]
+			if !ok {
+				continue
+			}
+			delete(ch.unacked, c.buf[i].DeliveryTag)
+			q.unacked--
+			if b.queues[q.name] == q {
+				b.requeue(q, d.message)
+			}
+		}
+		c.buf = nil
+	}
+	signal(c.wake)
+
+	if notify {
+		listeners := ch.cancelListeners
+		ch.notify(func() {
+			for _, l := range listeners {
+				l <- c.tag
+			}
+		})
+	}
+
+	if q.autoDelete && len(q.consumers) == 0 && b.queues[q.name] == q {
+		b.deleteQueue(q)
+	}
+}
+
+// notify queues f to be run by the notifier
+// The caller must hold the lock
+func (ch *Channel) notify(f func()) {
+	ch.events = append(ch.events, f)
+	signal(ch.wake)
+}
+
+// notifier runs events in order until the channel has closed
+// and every event has been run
+func (ch *Channel) notifier() {
+	b := ch.conn.broker
+	for {
+		b.mu.Lock()
+		if len(ch.events) == 0 {
+			closed := ch.closed
+			b.mu.Unlock()
+			if closed {
+				return
+			}
+			<-ch.wake
+			continue
+		}
+		f := ch.events[0]
+		ch.events = ch.events[1:]
+		b.mu.Unlock()
+		f()
+	}
+}
+
+// accessible returns an error if q is exclusive to another connection
+func (ch *Channel) accessible(q *queue) *amqp.Error {
+	if q.exclusive && q.owner != ch.conn {
+		return &amqp.Error{
+			Code:   amqp.ResourceLocked,
+			Reason: fmt.Sprintf("RESOURCE_LOCKED - cannot obtain exclusive access to locked queue '%s' in vhost '/'", q.name),
+		}
+	}
+	return nil
+}
+
+func (c *consumerState) hasCapacity() bool {
+	return c.autoAck || c.ch.prefetch == 0 || c.unacked < c.ch.prefetch
+}
+
+// deliver sends m to the consumer. The caller must hold the lock
+func (c *consumerState) deliver(q *queue, m *message) {
+	ch := c.ch
+	ch.tag++
+	if !c.autoAck {
+		ch.unacked[ch.tag] = &unackedDelivery{queue: q, message: m, consumer: c}
+		c.unacked++
+		q.unacked++
+	}
+
+	d := delivery(ch, m, ch.tag)
+	d.ConsumerTag = c.tag
+	c.buf = append(c.buf, d)
+	signal(c.wake)
+}
+
+// returned builds the amqp.Return for an unroutable mandatory message
+func returned(exName, key string, msg amqp.Publishing) amqp.Return {
+	return amqp.Return{
+		ReplyCode:       amqp.NoRoute,
+		ReplyText:       "NO_ROUTE",
+		Exchange:        exName,
+		RoutingKey:      key,
+		ContentType:     msg.ContentType,
+		ContentEncoding: msg.ContentEncoding,
+		Headers:         msg.Headers,
+		DeliveryMode:    msg.DeliveryMode,
+		Priority:        msg.Priority,
+		CorrelationId:   msg.CorrelationId,
+		ReplyTo:         msg.ReplyTo,
+		Expiration:      msg.Expiration,
+		MessageId:       msg.MessageId,
+		Timestamp:       msg.Timestamp,
+		Type:            msg.Type,
+		UserId:          msg.UserId,
+		AppId:           msg.AppId,
+		Body:            msg.Body,
+	}
+}
+
+// delivery builds the delivery of m with ch as its acknowledger
+func delivery(ch *Channel, m *message, tag uint64) amqp.Delivery {
+	return amqp.Delivery{
+		Acknowledger:    ch,
+		Headers:         m.msg.Headers,
+		ContentType:     m.msg.ContentType,
+		ContentEncoding: m.msg.ContentEncoding,
+		DeliveryMode:    m.msg.DeliveryMode,
+		Priority:        m.msg.Priority,
+		CorrelationId:   m.msg.CorrelationId,
+		ReplyTo:         m.msg.ReplyTo,
+		Expiration:      m.msg.Expiration,
+		MessageId:       m.msg.MessageId,
+		Timestamp:       m.msg.Timestamp,
+		Type:            m.msg.Type,
+		UserId:          m.msg.UserId,
+		AppId:           m.msg.AppId,
+		DeliveryTag:     tag,
+		Redelivered:     m.redelivered,
+		Exchange:        m.exchange,
+		RoutingKey:      m.routingKey,
+		Body:            m.msg.Body,
+	}
+}
+
+// pump sends buffered deliveries to the consumer until it's cancelled
+// or the channel closes, if it's draining once the buffer is empty
+func (c *consumerState) pump(mu *sync.Mutex) {
+	defer close(c.out)
+	for {
+		mu.Lock()
+		if c.cancelled || c.ch.closed || (c.draining && len(c.buf) == 0) {
+			mu.Unlock()
+			return
+		}
+		if len(c.buf) == 0 {
+			mu.Unlock()
+			<-c.wake
+			continue
+		}
+		d := c.buf[0]
+		c.buf = c.buf[1:]
+		mu.Unlock()
+		c.out <- d
+	}
+}
+
+func (q *queue) state() amqp.Queue {
+	return amqp.Queue{Name: q.name, Messages: len(q.ready), Consumers: len(q.consumers)}
+}
+
+// equivalent returns a PRECONDITION_FAILED error if the queue
+// is redeclared with different parameters
+func (q *queue) equivalent(durable, autoDelete, exclusive bool, args amqp.Table) *amqp.Error {
+	flags := []struct {
+		name              string
+		received, current bool
+	}{
+		{"durable", durable, q.durable},
+		{"exclusive", exclusive, q.exclusive},
+		{"auto_delete", autoDelete, q.autoDelete},
+	}
+	for _, f := range flags {
+		if f.received != f.current {
+			return inequivalent("queue", q.name, f.name, fmt.Sprintf("'%t'", f.received), fmt.Sprintf("'%t'", f.current))
+		}
+	}
+	if arg, received, current, ok := diffArgs(args, q.args); !ok {
+		return inequivalent("queue", q.name, arg, describeArg(received), describeArg(current))
+	}
+	return nil
+}
+
+// equivalent returns a PRECONDITION_FAILED error if the
+// exchange is redeclared with different parameters
+func (e *exchange) equivalent(kind string, durable, autoDelete, internal bool, args amqp.Table) *amqp.Error {
+	if kind != e.kind {
+		return inequivalent("exchange", e.name, "type", fmt.Sprintf("'%s'", kind), fmt.Sprintf("'%s'", e.kind))
+	}
+	flags := []struct {
+		name              string
+		received, current bool
+	}{
+		{"durable", durable, e.durable},
+		{"auto_delete", autoDelete, e.autoDelete},
+		{"internal", internal, e.internal},
+	}
+	for _, f := range flags {
+		if f.received != f.current {
+			return inequivalent("exchange", e.name, f.name, fmt.Sprintf("'%t'", f.received), fmt.Sprintf("'%t'", f.current))
+		}
+	}
+	if arg, received, current, ok := diffArgs(args, e.args); !ok {
+		return inequivalent("exchange", e.name, arg, describeArg(received), describeArg(current))
+	}
+	return nil
+}
+
+// inequivalent builds the error RabbitMq closes a channel
+// with when a declaration doesn't match the existing entity
+func inequivalent(kind, name, arg, received, current string) *amqp.Error {
+	return &amqp.Error{
+		Code:   amqp.PreconditionFailed,
+		Reason: fmt.Sprintf("PRECONDITION_FAILED - inequivalent arg '%s' for %s '%s' in vhost '/': received %s but current is %s", arg, kind, name, received, current),
+	}
+}
+
+func notFound(kind, name string) *amqp.Error {
+	return &amqp.Error{
+		Code:   amqp.NotFound,
+		Reason: fmt.Sprintf("NOT_FOUND - no %s '%s' in vhost '/'", kind, name),
+	}
+}
+
+// diffArgs compares the x- arguments of two tables returning
+// the first argument that differs in name order
+func diffArgs(received, current amqp.Table) (string, interface{}, interface{}, bool) {
+	keys := make([]string, 0, len(received)+len(current))
+	for k := range received {
+		keys = append(keys, k)
+	}
+	for k := range current {
+		if _, ok := received[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		r, c := received[k], current[k]
+		if !reflect.DeepEqual(normalise(r), normalise(c)) {
+			return k, r, c, false
+		}
+	}
+	return "", nil, nil, true
+}
+
+func describeArg(v interface{}) string {
+	if v == nil {
+		return "none"
+	}
+	var kind string
+	switch v.(type) {
+	case string:
+		kind = "longstr"
+	case bool:
+		kind = "bool"
+	case int32, int16, int8:
+		kind = "signedint"
+	case int, int64, uint, uint64, uint32, uint16, uint8:
+		kind = "long"
+	case float32, float64:
+		kind = "double"
+	default:
+		kind = "table"
+	}
+	return fmt.Sprintf("the value '%v' of type '%s'", v, kind)
+}
+
+// normalise converts integer types to int64 so values
+// declared with different int types compare equal
+func normalise(v interface{}) interface{} {
+	switch t := v.(type) {
+	case int:
+		return int64(t)
+	case int8:
+		return int64(t)
+	case int16:
+		return int64(t)
+	case int32:
+		return int64(t)
+	case uint:
+		return int64(t)
+	case uint8:
+		return int64(t)
+	case uint16:
+		return int64(t)
+	case uint32:
+		return int64(t)
+	case uint64:
+		return int64(t)
+	default:
+		return v
+	}
+}
+
+func equalTables(a, b amqp.Table) bool {
+	_, _, _, ok := diffArgs(a, b)
+	return ok
+}
+
+func copyTable(t amqp.Table) amqp.Table {
+	c := amqp.Table{}
+	for k, v := range t {
+		c[k] = v
+	}
+	return c
+}
+
+func signal(c chan struct{}) {
+	select {
+	case c <- struct{}{}:
+	default:
+	}
+}
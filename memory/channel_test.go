@@ -0,0 +1,88 @@
+package memory_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/streadway/amqp"
+	"github.com/theflyingcodr/rabbitmq/memory"
+)
+
+func TestCancelDeliversBufferedMessages(t *testing.T) {
+	b := memory.NewBroker()
+	conn, err := b.Dial("mem")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ch, err := conn.Channel()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ch.QueueDeclare("q", true, false, false, false, nil); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if err := ch.Publish("", "q", false, false, amqp.Publishing{Body: []byte("m")}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	msgs, err := ch.Consume("q", "tag", false, false, false, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := <-msgs
+	// wait for the others to be sent to the consumer
+	for deadline := time.Now().Add(time.Second); ; {
+		if q, _ := b.Queue("q"); q.Unacked == 3 || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if err := ch.Cancel("tag", false); err != nil {
+		t.Fatal(err)
+	}
+
+	// like amqp the deliveries already sent are received after the cancel
+	n := 1
+	first.Ack(false)
+	for d := range msgs {
+		if err := d.Ack(false); err != nil {
+			t.Fatal(err)
+		}
+		n++
+	}
+	if n != 3 {
+		t.Fatalf("received %d messages, want 3", n)
+	}
+	q, _ := b.Queue("q")
+	if q.Ready != 0 || q.Unacked != 0 || q.Consumers != 0 {
+		t.Fatalf("queue %+v, want it empty without consumers", q)
+	}
+}
+
+func TestCloseRequeuesBufferedMessages(t *testing.T) {
+	b := memory.NewBroker()
+	conn, _ := b.Dial("mem")
+	ch, _ := conn.Channel()
+	ch.QueueDeclare("q", true, false, false, false, nil)
+	for i := 0; i < 3; i++ {
+		ch.Publish("", "q", false, false, amqp.Publishing{Body: []byte("m")})
+	}
+	msgs, err := ch.Consume("q", "tag", false, false, false, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-msgs
+	if err := ch.Cancel("tag", false); err != nil {
+		t.Fatal(err)
+	}
+	if err := ch.Close(); err != nil {
+		t.Fatal(err)
+	}
+	for range msgs {
+	}
+	q, _ := b.Queue("q")
+	if q.Ready != 3 || q.Unacked != 0 {
+		t.Fatalf("queue %+v, want 3 messages requeued", q)
+	}
+}
@@ -0,0 +1,47 @@
+package memory
+
+import (
+	"strings"
+
+	"github.com/streadway/amqp"
+	"github.com/theflyingcodr/rabbitmq/consumer"
+)
+
+// Match reports whether a message published with the routing key
+// and headers is routed by a binding on an exchange of the kind
+// provided, in the same way RabbitMq would
+func Match(kind, bindingKey string, bindingArgs amqp.Table, key string, headers amqp.Table) bool {
+	switch kind {
+	case amqp.ExchangeFanout:
+		return true
+	case amqp.ExchangeTopic:
+		return consumer.MatchTopic(bindingKey, key)
+	case amqp.ExchangeHeaders:
+		return MatchHeaders(bindingArgs, headers)
+	default:
+		return bindingKey == key
+	}
+}
+
+// MatchHeaders reports whether message headers match the arguments of
+// a headers exchange binding. x-match all, the default, requires every
+// argument to be present with the same value, any requires at least one.
+// Arguments starting with x- are ignored
+func MatchHeaders(bindingArgs, headers amqp.Table) bool {
+	any := bindingArgs["x-match"] == "any"
+	for k, v := range bindingArgs {
+		if strings.HasPrefix(k, "x-") {
+			continue
+		}
+		h, ok := headers[k]
+		// a binding argument with no value only checks the header is present
+		equal := ok && (v == nil || normalise(h) == normalise(v))
+		if any && equal {
+			return true
+		}
+		if !any && !equal {
+			return false
+		}
+	}
+	return !any
+}
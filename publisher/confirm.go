@@ -0,0 +1,336 @@
+package publisher
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"sort"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/streadway/amqp"
+	"github.com/theflyingcodr/rabbitmq/consumer"
+)
+
+var (
+	ERRNACKED      = errors.New("message was nacked by the broker")
+	ERRCONFIRMLOST = errors.New("channel closed before the message was confirmed")
+	ERRUNROUTABLE  = errors.New("message was returned by the broker as it couldn't be routed to a queue")
+)
+
+// ConfirmConfig defines how a ConfirmPublisher treats
+// messages that are outstanding when its channel is lost
+type ConfirmConfig struct {
+	// Republish will publish outstanding messages again on
+	// the next channel instead of failing their confirmations,
+	// note this can result in the broker receiving duplicates.
+	// The message which made the broker close the channel, ie
+	// one published to an exchange that doesn't exist, isn't
+	// republished, it fails with the broker's error
+	Republish bool
+}
+
+// Confirmation is returned for each message published
+// with a ConfirmPublisher, it resolves when the broker
+// acks or nacks the message
+type Confirmation struct {
+	done chan struct{}
+	err  error
+}
+
+func newConfirmation() *Confirmation {
+	return &Confirmation{done: make(chan struct{})}
+}
+
+// Done is closed when the confirmation resolves
+func (c *Confirmation) Done() <-chan struct{} {
+	return c.done
+}
+
+// Err returns nil if the broker acked the message, ERRNACKED
+// if it was nacked, ERRUNROUTABLE if it wasn't routed to a queue,
+// or the error that prevented the message from being confirmed.
+// It should only be called once Done is closed
+func (c *Confirmation) Err() error {
+	return c.err
+}
+
+// Wait blocks until the confirmation resolves or ctx is done
+func (c *Confirmation) Wait(ctx context.Context) error {
+	select {
+	case <-c.done:
+		return c.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (c *Confirmation) resolve(err error) {
+	c.err = err
+	close(c.done)
+}
+
+// publishing is a message awaiting a confirm from the broker
+type publishing struct {
+	exchange     string
+	routingKey   string
+	msg          amqp.Publishing
+	confirmation *Confirmation
+	// returned is set when the broker returns the
+	// message as unroutable, its ack follows
+	returned bool
+}
+
+// confirmChannel tracks the messages published on a channel
+// by their delivery tag, tags restart at 1 on each channel
+type confirmChannel struct {
+	ch      consumer.Channel
+	seq     uint64
+	pending map[uint64]*publishing
+}
+
+// ConfirmPublisher publishes with its channel in confirm mode,
+// each publish returns a Confirmation which resolves when the
+// broker has taken responsibility for the message. Messages are
+// published as mandatory so those which can't be routed to a
+// queue fail with ERRUNROUTABLE
+//
+//	p := publisher.NewConfirmPublisher(host, publisher.ConfirmConfig{Republish: true})
+//	c, err := p.Publish(ctx, "test", "test.success", msg)
+//	if err != nil {
+//		return err
+//	}
+//	if err := c.Wait(ctx); err != nil {
+//		return err
+//	}
+type ConfirmPublisher struct {
+	publisher *Publisher
+	cfg       ConfirmConfig
+	mu        *sync.Mutex
+	current   *confirmChannel
+}
+
+// NewConfirmPublisher sets up a publisher which will publish
+// in confirm mode on connections supplied by the Connector
+func NewConfirmPublisher(c Connector, cfg ConfirmConfig) *ConfirmPublisher {
+	p := &ConfirmPublisher{
+		publisher: newPublisher(),
+		cfg:       cfg,
+		mu:        &sync.Mutex{},
+	}
+	p.publisher.onOpen = p.open
+	go p.publisher.channelLoop(c.NotifyConnect(make(chan consumer.Connection, 1)))
+	return p
+}
+
+// Publish sends msg to the exchange with the routing key provided and
+// returns a Confirmation for it. ctx limits how long we wait for a
+// channel, use Confirmation.Wait to wait for the broker's confirm
+func (p *ConfirmPublisher) Publish(ctx context.Context, exchange, routingKey string, msg amqp.Publishing) (*Confirmation, error) {
+	pub := &publishing{
+		exchange:     exchange,
+		routingKey:   routingKey,
+		msg:          msg,
+		confirmation: newConfirmation(),
+	}
+	if err := p.publish(ctx, pub); err != nil {
+		return nil, err
+	}
+	return pub.confirmation, nil
+}
+
+// PublishAndWait publishes msg and waits for the broker
+// to confirm it or for ctx to be done
+func (p *ConfirmPublisher) PublishAndWait(ctx context.Context, exchange, routingKey string, msg amqp.Publishing) error {
+	c, err := p.Publish(ctx, exchange, routingKey, msg)
+	if err != nil {
+		return err
+	}
+	return c.Wait(ctx)
+}
+
+// Close stops the publisher and closes its channel, messages
+// that haven't been confirmed fail with ERRPUBLISHERCLOSED
+func (p *ConfirmPublisher) Close() error {
+	return p.publisher.Close()
+}
+
+func (p *ConfirmPublisher) publish(ctx context.Context, pub *publishing) error {
+	for {
+		ch, err := p.publisher.channel(ctx)
+		if err != nil {
+			return err
+		}
+
+		p.mu.Lock()
+		cc := p.current
+		if cc == nil || cc.ch != ch {
+			// the channel has closed or been replaced since we fetched it
+			p.mu.Unlock()
+			p.publisher.lost(ch)
+			continue
+		}
+		cc.seq++
+		cc.pending[cc.seq] = pub
+		err = ch.Publish(pub.exchange, pub.routingKey, true, false, pub.msg)
+		if err != nil {
+			// the broker only counts messages that were sent
+			delete(cc.pending, cc.seq)
+			cc.seq--
+		}
+		p.mu.Unlock()
+
+		if err != amqp.ErrClosed {
+			return err
+		}
+		p.publisher.lost(ch)
+	}
+}
+
+// open puts a new channel into confirm mode and starts
+// listening for its confirms & returns
+func (p *ConfirmPublisher) open(ch consumer.Channel) error {
+	if err := ch.Confirm(false); err != nil {
+		return err
+	}
+
+	cc := &confirmChannel{ch: ch, pending: make(map[uint64]*publishing)}
+	confirms := ch.NotifyPublish(make(chan amqp.Confirmation, 100))
+	// returns aren't buffered so each is received
+	// before the confirm which follows it is sent
+	returns := ch.NotifyReturn(make(chan amqp.Return))
+	closed := ch.NotifyClose(make(chan *amqp.Error, 1))
+
+	p.mu.Lock()
+	p.current = cc
+	p.mu.Unlock()
+
+	go p.listen(cc, confirms, returns, closed)
+	return nil
+}
+
+// returned marks the pending message matching r as returned,
+// the oldest is marked if the same message is pending more than once.
+// The caller must hold the lock
+func (cc *confirmChannel) returned(r amqp.Return) {
+	var first uint64
+	for t, pub := range cc.pending {
+		if pub.returned || pub.exchange != r.Exchange || pub.routingKey != r.RoutingKey || !bytes.Equal(pub.msg.Body, r.Body) {
+			continue
+		}
+		if first == 0 || t < first {
+			first = t
+		}
+	}
+	if first != 0 {
+		cc.pending[first].returned = true
+	}
+}
+
+// channelError reports whether err closed just the channel, ie the
+// broker rejected a message published on it, rather than the connection
+func channelError(err *amqp.Error) bool {
+	if err == nil || !err.Server {
+		return false
+	}
+	switch err.Code {
+	case amqp.ContentTooLarge, amqp.NoRoute, amqp.NoConsumers, amqp.AccessRefused,
+		amqp.NotFound, amqp.ResourceLocked, amqp.PreconditionFailed:
+		return true
+	}
+	return false
+}
+
+// listen resolves confirmations as the broker acks and nacks
+// messages. When the channel closes any messages still pending
+// are either failed or republished depending on config, if the
+// broker closed the channel the oldest is the message it rejected
+// so that fails with the broker's error
+func (p *ConfirmPublisher) listen(cc *confirmChannel, confirms chan amqp.Confirmation, returns chan amqp.Return, closed chan *amqp.Error) {
+	for confirms != nil {
+		select {
+		case r, ok := <-returns:
+			if !ok {
+				returns = nil
+				continue
+			}
+			p.mu.Lock()
+			cc.returned(r)
+			p.mu.Unlock()
+		case c, ok := <-confirms:
+			if !ok {
+				confirms = nil
+				continue
+			}
+			p.mu.Lock()
+			pub, ok := cc.pending[c.DeliveryTag]
+			delete(cc.pending, c.DeliveryTag)
+			p.mu.Unlock()
+			if !ok {
+				continue
+			}
+
+			switch {
+			case !c.Ack:
+				pub.confirmation.resolve(ERRNACKED)
+			case pub.returned:
+				pub.confirmation.resolve(ERRUNROUTABLE)
+			default:
+				pub.confirmation.resolve(nil)
+			}
+		}
+	}
+	if returns != nil {
+		for range returns {
+		}
+	}
+	closeErr := <-closed
+
+	p.mu.Lock()
+	tags := make([]uint64, 0, len(cc.pending))
+	for t := range cc.pending {
+		tags = append(tags, t)
+	}
+	sort.Slice(tags, func(i, j int) bool { return tags[i] < tags[j] })
+	outstanding := make([]*publishing, 0, len(tags))
+	for _, t := range tags {
+		outstanding = append(outstanding, cc.pending[t])
+	}
+	cc.pending = nil
+	if p.current == cc {
+		p.current = nil
+	}
+	p.mu.Unlock()
+
+	if len(outstanding) > 0 && channelError(closeErr) {
+		log.Errorf("channel closed by the broker, failing the message it rejected: %s", closeErr)
+		outstanding[0].confirmation.resolve(closeErr)
+		outstanding = outstanding[1:]
+	}
+	if len(outstanding) == 0 {
+		return
+	}
+
+	if !p.cfg.Republish {
+		log.Errorf("channel closed with %d unconfirmed messages", len(outstanding))
+		err := ERRCONFIRMLOST
+		select {
+		case <-p.publisher.done:
+			err = ERRPUBLISHERCLOSED
+		default:
+		}
+		for _, pub := range outstanding {
+			pub.confirmation.resolve(err)
+		}
+		return
+	}
+
+	log.Infof("channel closed with %d unconfirmed messages, republishing", len(outstanding))
+	for _, pub := range outstanding {
+		// publish waits for the replacement channel and
+		// fails once the publisher has been closed
+		if err := p.publish(context.Background(), pub); err != nil {
+			pub.confirmation.resolve(err)
+		}
+	}
+}
@@ -0,0 +1,190 @@
+package publisher_test
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/streadway/amqp"
+	"github.com/theflyingcodr/rabbitmq/consumer"
+	"github.com/theflyingcodr/rabbitmq/memory"
+	"github.com/theflyingcodr/rabbitmq/publisher"
+)
+
+// unconfirmed wraps a connection so the broker's confirms are
+// dropped while hold is set, leaving messages outstanding
+type unconfirmed struct {
+	consumer.Connection
+	hold *atomic.Bool
+}
+
+func (c *unconfirmed) Channel() (consumer.Channel, error) {
+	ch, err := c.Connection.Channel()
+	if err != nil {
+		return nil, err
+	}
+	return &unconfirmedChannel{Channel: ch, hold: c.hold}, nil
+}
+
+type unconfirmedChannel struct {
+	consumer.Channel
+	hold *atomic.Bool
+}
+
+func (ch *unconfirmedChannel) NotifyPublish(l chan amqp.Confirmation) chan amqp.Confirmation {
+	confirms := ch.Channel.NotifyPublish(make(chan amqp.Confirmation, cap(l)))
+	go func() {
+		defer close(l)
+		for c := range confirms {
+			if !ch.hold.Load() {
+				l <- c
+			}
+		}
+	}()
+	return l
+}
+
+// connectUnconfirmed sends the publisher a connection
+// which drops confirms while hold is set
+func (c *connector) connectUnconfirmed(t *testing.T, b *memory.Broker, hold *atomic.Bool) {
+	t.Helper()
+	conn, err := b.Dial("mem")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	c.conns <- &unconfirmed{Connection: conn, hold: hold}
+}
+
+func TestConfirmPublishAndWait(t *testing.T) {
+	b := setup(t)
+	c := newConnector()
+	p := publisher.NewConfirmPublisher(c, publisher.ConfirmConfig{})
+	defer p.Close()
+	c.connect(t, b)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	for i := 0; i < 3; i++ {
+		if err := p.PublishAndWait(ctx, "ex", "k", msg("m")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ready(t, b, 3)
+}
+
+func TestConfirmLostWithChannel(t *testing.T) {
+	b := setup(t)
+	c := newConnector()
+	p := publisher.NewConfirmPublisher(c, publisher.ConfirmConfig{})
+	defer p.Close()
+	hold := &atomic.Bool{}
+	hold.Store(true)
+	c.connectUnconfirmed(t, b, hold)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	confirmation, err := p.Publish(ctx, "ex", "k", msg("m"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.Disconnect()
+	if err := confirmation.Wait(ctx); !errors.Is(err, publisher.ERRCONFIRMLOST) {
+		t.Fatalf("got %v, want confirm lost", err)
+	}
+}
+
+func TestConfirmRepublishesOnNewChannel(t *testing.T) {
+	b := setup(t)
+	c := newConnector()
+	p := publisher.NewConfirmPublisher(c, publisher.ConfirmConfig{Republish: true})
+	defer p.Close()
+	hold := &atomic.Bool{}
+	hold.Store(true)
+	c.connectUnconfirmed(t, b, hold)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	confirmation, err := p.Publish(ctx, "ex", "k", msg("m"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.Disconnect()
+	select {
+	case <-confirmation.Done():
+		t.Fatalf("resolved with %v before reconnecting", confirmation.Err())
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	hold.Store(false)
+	c.connect(t, b)
+	if err := confirmation.Wait(ctx); err != nil {
+		t.Fatal(err)
+	}
+	// the message was routed before the confirm was lost
+	// and again when it was republished
+	ready(t, b, 2)
+}
+
+func TestConfirmCloseFailsOutstanding(t *testing.T) {
+	b := setup(t)
+	c := newConnector()
+	p := publisher.NewConfirmPublisher(c, publisher.ConfirmConfig{})
+	hold := &atomic.Bool{}
+	hold.Store(true)
+	c.connectUnconfirmed(t, b, hold)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	confirmation, err := p.Publish(ctx, "ex", "k", msg("m"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := confirmation.Wait(ctx); !errors.Is(err, publisher.ERRPUBLISHERCLOSED) {
+		t.Fatalf("got %v, want publisher closed", err)
+	}
+}
+
+func TestConfirmUnroutable(t *testing.T) {
+	b := setup(t)
+	c := newConnector()
+	p := publisher.NewConfirmPublisher(c, publisher.ConfirmConfig{})
+	defer p.Close()
+	c.connect(t, b)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := p.PublishAndWait(ctx, "ex", "nowhere", msg("m")); !errors.Is(err, publisher.ERRUNROUTABLE) {
+		t.Fatalf("got %v, want unroutable", err)
+	}
+	if err := p.PublishAndWait(ctx, "ex", "k", msg("m")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestConfirmRepublishFailsRejectedMessage(t *testing.T) {
+	b := setup(t)
+	c := newConnector()
+	p := publisher.NewConfirmPublisher(c, publisher.ConfirmConfig{Republish: true})
+	defer p.Close()
+	c.connect(t, b)
+
+	// the broker closes the channel for an exchange that doesn't
+	// exist, the message fails rather than being republished
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	err := p.PublishAndWait(ctx, "missing", "k", msg("m"))
+	var e *amqp.Error
+	if !errors.As(err, &e) || e.Code != amqp.NotFound {
+		t.Fatalf("got %v, want NOT_FOUND", err)
+	}
+	if err := p.PublishAndWait(ctx, "ex", "k", msg("m")); err != nil {
+		t.Fatal(err)
+	}
+	ready(t, b, 1)
+}
@@ -0,0 +1,154 @@
+package publisher_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/streadway/amqp"
+	"github.com/theflyingcodr/rabbitmq/consumer"
+	"github.com/theflyingcodr/rabbitmq/memory"
+	"github.com/theflyingcodr/rabbitmq/publisher"
+)
+
+// connector hands the publisher the connections sent to connect,
+// as the host does when it connects & reconnects
+type connector struct {
+	conns chan consumer.Connection
+}
+
+func newConnector() *connector {
+	return &connector{conns: make(chan consumer.Connection, 1)}
+}
+
+func (c *connector) NotifyConnect(chan consumer.Connection) chan consumer.Connection {
+	return c.conns
+}
+
+// connect dials the broker and sends the connection to the publisher
+func (c *connector) connect(t *testing.T, b *memory.Broker) {
+	t.Helper()
+	conn, err := b.Dial("mem")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	c.conns <- conn
+}
+
+// setup declares exchange ex with queue q bound to it by key k
+func setup(t *testing.T) *memory.Broker {
+	t.Helper()
+	b := memory.NewBroker()
+	conn, err := b.Dial("mem")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	ch, err := conn.Channel()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ch.ExchangeDeclare("ex", consumer.TOPIC_EXCHANGE, true, false, false, false, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ch.QueueDeclare("q", true, false, false, false, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := ch.QueueBind("q", "k", "ex", false, nil); err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func ready(t *testing.T, b *memory.Broker, want int) {
+	t.Helper()
+	for deadline := time.Now().Add(time.Second); ; time.Sleep(5 * time.Millisecond) {
+		q, _ := b.Queue("q")
+		if q.Ready == want {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d messages ready, want %d", q.Ready, want)
+		}
+	}
+}
+
+func msg(body string) amqp.Publishing {
+	return amqp.Publishing{Body: []byte(body)}
+}
+
+func TestPublishWaitsForConnection(t *testing.T) {
+	b := setup(t)
+	c := newConnector()
+	p := publisher.NewPublisher(c)
+	defer p.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := p.Publish(ctx, "ex", "k", msg("early")); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("got %v, want deadline exceeded", err)
+	}
+
+	published := make(chan error, 1)
+	go func() { published <- p.Publish(context.Background(), "ex", "k", msg("m")) }()
+	c.connect(t, b)
+	if err := <-published; err != nil {
+		t.Fatal(err)
+	}
+	ready(t, b, 1)
+}
+
+func TestPublishAfterReconnect(t *testing.T) {
+	b := setup(t)
+	c := newConnector()
+	p := publisher.NewPublisher(c)
+	defer p.Close()
+	c.connect(t, b)
+	if err := p.Publish(context.Background(), "ex", "k", msg("before")); err != nil {
+		t.Fatal(err)
+	}
+
+	b.Disconnect()
+	c.connect(t, b)
+	if err := p.Publish(context.Background(), "ex", "k", msg("after")); err != nil {
+		t.Fatal(err)
+	}
+	ready(t, b, 2)
+}
+
+func TestPublishReopensClosedChannel(t *testing.T) {
+	b := setup(t)
+	c := newConnector()
+	p := publisher.NewPublisher(c)
+	defer p.Close()
+	c.connect(t, b)
+
+	// publishing to a missing exchange closes the channel
+	if err := p.Publish(context.Background(), "missing", "k", msg("lost")); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := p.Publish(ctx, "ex", "k", msg("m")); err != nil {
+		t.Fatal(err)
+	}
+	ready(t, b, 1)
+}
+
+func TestPublishAfterClose(t *testing.T) {
+	b := setup(t)
+	c := newConnector()
+	p := publisher.NewPublisher(c)
+	c.connect(t, b)
+	if err := p.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Publish(context.Background(), "ex", "k", msg("m")); !errors.Is(err, publisher.ERRPUBLISHERCLOSED) {
+		t.Fatalf("got %v, want publisher closed", err)
+	}
+	if err := p.Close(); !errors.Is(err, publisher.ERRPUBLISHERCLOSED) {
+		t.Fatalf("second close got %v", err)
+	}
+}